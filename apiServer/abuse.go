@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// ABUSE_WEBHOOK_URL receives an AbuseAlert when a token's verifications
+	// turn out mostly invalid or failed. Tracking is off while it is empty.
+	ABUSE_WEBHOOK_URL string
+	// ABUSE_THRESHOLD is the share of invalid or failed verifications in a
+	// window above which a token is reported.
+	ABUSE_THRESHOLD = 0.5
+	// ABUSE_MIN_EMAILS is how many verifications a window needs before the
+	// share counts, so a few typos don't raise an alert.
+	ABUSE_MIN_EMAILS = 100
+	// ABUSE_WINDOW is how long counts accumulate before being reset. A token
+	// is reported at most once per window.
+	ABUSE_WINDOW = time.Hour
+)
+
+// abuse tracks the verifications of each token in memory.
+var abuse = &abuseTracker{windows: map[string]*abuseWindow{}}
+
+// AbuseAlert is posted to ABUSE_WEBHOOK_URL. Token is a fingerprint of the
+// token, never the token itself.
+type AbuseAlert struct {
+	Token       string  `json:"token"`
+	WindowStart string  `json:"window_start"`
+	Window      string  `json:"window"`
+	Emails      int     `json:"emails"`
+	Invalid     int     `json:"invalid"` // invalid syntax or no MX records
+	Failed      int     `json:"failed"`  // verifications that errored
+	Ratio       float64 `json:"ratio"`
+}
+
+type abuseTracker struct {
+	mu      sync.Mutex
+	windows map[string]*abuseWindow
+}
+
+// abuseWindow counts the verifications of a token since start.
+type abuseWindow struct {
+	start           time.Time
+	emails          int
+	invalid, failed int
+	alerted         bool
+}
+
+// record counts a verification made for the token with fingerprint id, and
+// posts an alert when the token crosses ABUSE_THRESHOLD.
+func (t *abuseTracker) record(id string, v *Verification, err error) {
+	if ABUSE_WEBHOOK_URL == "" {
+		return
+	}
+
+	t.mu.Lock()
+	w, ok := t.windows[id]
+	if !ok || time.Since(w.start) > ABUSE_WINDOW {
+		w = &abuseWindow{start: time.Now()}
+		t.windows[id] = w
+	}
+	w.emails++
+	switch {
+	case err != nil:
+		w.failed++
+	case !v.Result.Syntax.Valid, !v.Result.HasMxRecords && !v.Result.Disposable:
+		w.invalid++
+	}
+	ratio := float64(w.invalid+w.failed) / float64(w.emails)
+	if w.alerted || w.emails < ABUSE_MIN_EMAILS || ratio <= ABUSE_THRESHOLD {
+		t.mu.Unlock()
+		return
+	}
+	w.alerted = true
+	alert := AbuseAlert{
+		Token:       id,
+		WindowStart: w.start.UTC().Format(time.RFC3339),
+		Window:      ABUSE_WINDOW.String(),
+		Emails:      w.emails,
+		Invalid:     w.invalid,
+		Failed:      w.failed,
+		Ratio:       ratio,
+	}
+	t.mu.Unlock()
+
+	log.Printf("Token %s: %d of %d verifications invalid or failed, reporting", id, alert.Invalid+alert.Failed, alert.Emails)
+	go sendAbuseAlert(alert)
+}
+
+func sendAbuseAlert(alert AbuseAlert) {
+	body, _ := json.Marshal(alert)
+	resp, err := httpClient.Post(ABUSE_WEBHOOK_URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Abuse webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Abuse webhook answered %s", resp.Status)
+	}
+}
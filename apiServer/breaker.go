@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sony/gobreaker"
+)
+
+var (
+	// SMTP_BREAKER_THRESHOLD is the number of consecutive failed SMTP checks
+	// after which they are short-circuited. Zero disables the breaker.
+	SMTP_BREAKER_THRESHOLD = 0
+	// SMTP_BREAKER_COOLDOWN is how long the breaker stays open before a
+	// single check is let through to test whether SMTP recovered.
+	SMTP_BREAKER_COOLDOWN = 30 * time.Second
+)
+
+// noteSMTPUnavailable is reported when the breaker skipped the SMTP check.
+const noteSMTPUnavailable = "smtp_unavailable"
+
+// errSMTPUnavailable is returned by probeThroughBreaker while the breaker
+// is open.
+var errSMTPUnavailable = errors.New("SMTP checks are temporarily unavailable")
+
+// smtpBreaker guards the SMTP checks during upstream outages, when every
+// check would otherwise wait for its timeouts. It is nil when disabled.
+var smtpBreaker *gobreaker.CircuitBreaker
+
+func newSMTPBreaker(threshold int, cooldown time.Duration) *gobreaker.CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:    "smtp",
+		Timeout: cooldown,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= uint32(threshold)
+		},
+		OnStateChange: func(_ string, from, to gobreaker.State) {
+			log.Printf("SMTP circuit breaker %s -> %s", from, to)
+		},
+		IsSuccessful: func(err error) bool {
+			return !upstreamFailure(err)
+		},
+	})
+}
+
+// upstreamFailure reports whether err is an outage of the SMTP checks as a
+// whole, a proxy that is unreachable or rejects its credentials, rather
+// than a single domain's mail servers failing or the request ending.
+func upstreamFailure(err error) bool {
+	var lookupErr *emailVerifier.LookupError
+	if !errors.As(err, &lookupErr) {
+		return false
+	}
+	return lookupErr.Message == ErrProxyUnreachable || lookupErr.Message == ErrProxyAuthFailed
+}
+
+// probeThroughBreaker runs probe through the breaker. Only upstream
+// failures count towards opening it, mailbox rejections, unreachable mail
+// servers and cancelled checks don't.
+func probeThroughBreaker(ctx context.Context, probe *smtpProbe, domain, username string) (*emailVerifier.SMTP, *smtpReply, error) {
+	if smtpBreaker == nil {
+		return probe.check(ctx, domain, username)
+	}
+
+	var reply *smtpReply
+	ret, err := smtpBreaker.Execute(func() (interface{}, error) {
+		smtp, r, err := probe.check(ctx, domain, username)
+		reply = r
+		return smtp, err
+	})
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return nil, nil, errSMTPUnavailable
+	}
+	smtp, _ := ret.(*emailVerifier.SMTP)
+	return smtp, reply, err
+}
+
+// BreakerStats describes the state of a circuit breaker.
+type BreakerStats struct {
+	Enabled             bool   `json:"enabled"`
+	State               string `json:"state,omitempty"` // closed, open or half-open
+	Requests            uint32 `json:"requests"`
+	TotalFailures       uint32 `json:"total_failures"`
+	ConsecutiveFailures uint32 `json:"consecutive_failures"`
+}
+
+// Stats is the runtime state reported by /stats.
+type Stats struct {
+	SMTPBreaker BreakerStats `json:"smtp_breaker"`
+	// QueueTimeouts counts the bulk verifications that gave up waiting for
+	// a slot, see MAX_QUEUE_WAIT
+	QueueTimeouts int64 `json:"queue_timeouts"`
+	// DegradeLevel is how many checks of DEGRADE_ORDER are being dropped
+	DegradeLevel int `json:"degrade_level"`
+}
+
+// GetStats returns the runtime state of the server
+func GetStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var stats Stats
+	if smtpBreaker != nil {
+		counts := smtpBreaker.Counts()
+		stats.SMTPBreaker = BreakerStats{
+			Enabled:             true,
+			State:               smtpBreaker.State().String(),
+			Requests:            counts.Requests,
+			TotalFailures:       counts.TotalFailures,
+			ConsecutiveFailures: counts.ConsecutiveFailures,
+		}
+	}
+	if bulkSlots != nil {
+		stats.QueueTimeouts = bulkSlots.queueTimeouts.Load()
+	}
+	stats.DegradeLevel = degradeLevel()
+	respondWithJSON(w, r, http.StatusOK, stats)
+}
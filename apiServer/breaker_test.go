@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestBreakerCountsUpstreamFailuresOnly(t *testing.T) {
+	defer func(breaker *gobreaker.CircuitBreaker) { smtpBreaker = breaker }(smtpBreaker)
+	smtpBreaker = newSMTPBreaker(2, time.Minute)
+
+	// Nothing listens on port 25 of the loopback address
+	probe := smtpProbe{
+		heloNames:        []string{"example.com"},
+		proxies:          newProxyPool(nil, 0),
+		connectTimeout:   time.Second,
+		operationTimeout: time.Second,
+		mxHost:           "127.0.0.1",
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	jittered := probe
+	jittered.jitterMax = time.Hour
+
+	for range 3 {
+		if _, _, err := probeThroughBreaker(context.Background(), &probe, "example.com", ""); err == nil {
+			t.Fatal("probe of a closed port succeeded")
+		}
+		if _, _, err := probeThroughBreaker(cancelled, &jittered, "example.com", ""); !errors.Is(err, context.Canceled) {
+			t.Fatalf("cancelled probe returned %v", err)
+		}
+	}
+	if state := smtpBreaker.State(); state != gobreaker.StateClosed {
+		t.Fatalf("breaker %s after per-domain and cancelled failures, want closed", state)
+	}
+
+	// An unreachable proxy is an outage
+	proxied := probe
+	proxied.proxies = newProxyPool([]string{"socks5://127.0.0.1:1"}, 0)
+	for range 2 {
+		if _, _, err := probeThroughBreaker(context.Background(), &proxied, "example.com", ""); !upstreamFailure(err) {
+			t.Fatalf("probe through an unreachable proxy returned %v", err)
+		}
+	}
+	if _, _, err := probeThroughBreaker(context.Background(), &probe, "example.com", ""); !errors.Is(err, errSMTPUnavailable) {
+		t.Errorf("probe after two proxy failures returned %v, want the breaker open", err)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bulkOptions shape the per-email results of a bulk verification.
+type bulkOptions struct {
+	lenient     bool // let malformed emails through as syntax-invalid results
+	smtpDetails bool // include the raw SMTP reply
+	keyByEmail  bool // respond with an object keyed by email instead of an array
+	byClass     bool // order the results by classification, see sortByClassification
+	failFast    bool // give up on the first verification that errors
+	verify      verifyOptions
+	response    responseOptions
+
+	maxQueueWait time.Duration  // see MAX_QUEUE_WAIT
+	pool         *fairScheduler // acquired before bulkSlots when not nil, see JOB_CONCURRENCY
+}
+
+func bulkOptionsFromRequest(r *http.Request) bulkOptions {
+	verify := verifyOptionsFromRequest(r)
+	verify.Bulk = true
+	return bulkOptions{
+		lenient: r.URL.Query().Get("lenient") == "true",
+		// Raw SMTP replies are opt-in since most clients only need the verdict
+		smtpDetails: r.URL.Query().Get("smtp_details") == "true",
+		keyByEmail:  r.URL.Query().Get("shape") == "map",
+		byClass:     r.URL.Query().Get("sort") == "classification",
+		failFast:    r.URL.Query().Get("fail_fast") == "true",
+		verify:      verify,
+		response:    responseOptionsFromRequest(r),
+
+		maxQueueWait: MAX_QUEUE_WAIT,
+	}
+}
+
+// BULK_CANCEL_GRACE is how long a cancelled bulk verification waits for the
+// verifications in flight before returning what has completed. Requests
+// with a short timeout get less, see cancelGrace.
+var BULK_CANCEL_GRACE = 2 * time.Second
+
+// cancelGrace is BULK_CANCEL_GRACE, or a quarter of the time left before
+// the deadline of ctx when that is shorter, so a short X-Max-Duration
+// still leaves most of it to verify.
+func cancelGrace(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return BULK_CANCEL_GRACE
+	}
+	return max(0, min(BULK_CANCEL_GRACE, time.Until(deadline)/4))
+}
+
+// BULK_SYNC_DEADLINE is how long a bulk request verifies synchronously.
+// When it runs out, the emails left are handed to a background job and the
+// request is answered 202 with the completed results and the job. Zero
+// keeps bulk requests synchronous until REQUEST_TIMEOUT, returning partial
+// results.
+var BULK_SYNC_DEADLINE time.Duration
+
+// bulkOutcome holds the results of a bulk verification in input order.
+// When the context ends before every email is verified, partial is set and
+// results only holds the completed verifications.
+type bulkOutcome struct {
+	results   []BulkVerificationResult
+	remaining []string // emails that weren't verified, in input order
+	partial   bool
+	reason    string                  // why the outcome is partial
+	failed    *BulkVerificationResult // the error that stopped a failFast verification
+	cacheHits int                     // emails answered from the cache without a slot
+}
+
+// Reasons of outcomes cut short because a verification waited more than
+// maxQueueWait for a slot, errored with failFast set, or because the
+// context's deadline passed.
+const (
+	bulkReasonQueueTimeout = "queue_timeout"
+	bulkReasonFailed       = "failed"
+	bulkReasonDeadline     = "deadline_exceeded"
+)
+
+// PartialBulkResponse is returned instead of the plain results array when a
+// bulk verification couldn't complete.
+type PartialBulkResponse struct {
+	Partial bool                     `json:"partial"`
+	Reason  string                   `json:"reason"`
+	Results []BulkVerificationResult `json:"results"`
+	// Job verifies the remaining emails, see BULK_SYNC_DEADLINE
+	Job *JobResponse `json:"job,omitempty"`
+}
+
+// verifyAll verifies emails with at most workers verifications in flight,
+// each of them holding a slot of opts.pool and one of the shared bulkSlots.
+// Each address is verified once, the cached ones first without a slot, and
+// its result repeated at each of its positions. Other forms of it with the
+// same addressKey, the key of the cache, are answered from the cache its
+// verification filled. onDone, when not
+// nil, is called for each email once its verification completes. Once ctx
+// is done no new verification starts, the ones still waiting stop and are
+// left remaining, and SMTP dialogs in flight get the cancelGrace of ctx to
+// finish. With opts.failFast the first verification that errors ends ctx
+// the same way.
+func verifyAll(ctx context.Context, verifier *Verifier, emails []string, workers int, opts bulkOptions, onDone func()) bulkOutcome {
+	// Each result reports the email in the form given, so the other forms
+	// of an address are kept to be answered apart
+	var unique []string
+	var occurrences []int
+	var variants [][]string
+	uniqueIndex := make(map[string]int, len(emails))
+	for _, email := range emails {
+		key := addressKey(email)
+		i, seen := uniqueIndex[key]
+		if !seen {
+			i = len(unique)
+			uniqueIndex[key] = i
+			unique = append(unique, email)
+			occurrences = append(occurrences, 0)
+			variants = append(variants, nil)
+		} else if email != unique[i] && !slices.Contains(variants[i], email) {
+			variants[i] = append(variants[i], email)
+		}
+		occurrences[i]++
+	}
+	completed := func(i int) {
+		for n := 0; n < occurrences[i] && onDone != nil; n++ {
+			onDone()
+		}
+	}
+
+	// Forced verifications refresh the cache, the other forms can then
+	// use it. Results that weren't cached are repeated instead.
+	variantOpts := opts
+	variantOpts.verify.Force = false
+	variantsOf := func(i int, res BulkVerificationResult) map[string]BulkVerificationResult {
+		if len(variants[i]) == 0 {
+			return nil
+		}
+		_, cached := cache.peek(opts.verify.cacheKey(addressKey(unique[i])))
+		forms := make(map[string]BulkVerificationResult, len(variants[i]))
+		for _, form := range variants[i] {
+			if cached && res.Error == "" {
+				forms[form] = verifyOne(ctx, verifier, form, variantOpts)
+			} else {
+				res.Email = form
+				forms[form] = res
+			}
+		}
+		return forms
+	}
+
+	var mu sync.Mutex
+	results := make([]BulkVerificationResult, len(unique))
+	done := make([]bool, len(unique))
+	variantResults := map[string]BulkVerificationResult{}
+	var uncached []int
+	cacheHits := 0
+	for i, email := range unique {
+		if _, hit := cache.peek(opts.verify.cacheKey(addressKey(email))); !hit || opts.verify.Force {
+			uncached = append(uncached, i)
+			continue
+		}
+		results[i], done[i] = verifyOne(ctx, verifier, email, opts), true
+		maps.Copy(variantResults, variantsOf(i, results[i]))
+		cacheHits++
+		completed(i)
+	}
+	indexes := make(chan int)
+
+	grace := cancelGrace(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var queueTimedOut atomic.Bool
+	var failed *BulkVerificationResult
+
+	// A tenant waits in a single scheduler at a time
+	tenant, poolTenant := &bulkTenant{}, &bulkTenant{}
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(uncached)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if opts.pool.acquire(ctx, poolTenant, 0) != nil {
+					continue
+				}
+				if err := bulkSlots.acquire(ctx, tenant, opts.maxQueueWait); err != nil {
+					opts.pool.release()
+					if errors.Is(err, errQueueTimeout) {
+						queueTimedOut.Store(true)
+						cancel()
+					}
+					continue
+				}
+				res := verifyOne(ctx, verifier, unique[i], opts)
+				bulkSlots.release()
+				opts.pool.release()
+				if res.Error != "" && ctx.Err() != nil {
+					// Cut short once ctx ended, left with the remaining emails
+					continue
+				}
+				forms := variantsOf(i, res)
+				mu.Lock()
+				results[i], done[i] = res, true
+				maps.Copy(variantResults, forms)
+				if opts.failFast && res.Error != "" && failed == nil {
+					failed = &results[i]
+					cancel()
+				}
+				mu.Unlock()
+				completed(i)
+			}
+		}()
+	}
+
+dispatch:
+	for _, i := range uncached {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(indexes)
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		select {
+		case <-finished:
+		case <-time.After(grace):
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	outcome := bulkOutcome{results: make([]BulkVerificationResult, 0, len(emails)), failed: failed, cacheHits: cacheHits}
+	for _, email := range emails {
+		switch i := uniqueIndex[addressKey(email)]; {
+		case !done[i]:
+			outcome.remaining = append(outcome.remaining, email)
+		case email == unique[i]:
+			outcome.results = append(outcome.results, results[i])
+		default:
+			outcome.results = append(outcome.results, variantResults[email])
+		}
+	}
+	if len(outcome.results) < len(emails) {
+		outcome.partial = true
+		outcome.reason = "cancelled"
+		switch {
+		case failed != nil:
+			outcome.reason = bulkReasonFailed
+		case queueTimedOut.Load():
+			outcome.reason = bulkReasonQueueTimeout
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			outcome.reason = bulkReasonDeadline
+		}
+	}
+	return outcome
+}
+
+// bulkContext derives the context of a bulk verification from the request
+// context, ending it early enough before the request deadline that partial
+// results can still be sent, and by BULK_SYNC_DEADLINE when set.
+func bulkContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		if BULK_SYNC_DEADLINE <= 0 {
+			return context.WithCancel(ctx)
+		}
+		return context.WithTimeout(ctx, BULK_SYNC_DEADLINE)
+	}
+	deadline = deadline.Add(-2 * cancelGrace(ctx))
+	if sync := time.Now().Add(BULK_SYNC_DEADLINE); BULK_SYNC_DEADLINE > 0 && sync.Before(deadline) {
+		deadline = sync
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// verifyOne verifies a single email of a bulk request.
+func verifyOne(ctx context.Context, verifier *Verifier, email string, opts bulkOptions) BulkVerificationResult {
+	verification, err := verifier.Verify(ctx, email, opts.verify)
+	res := BulkVerificationResult{Email: email}
+
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Result = newVerificationResponse(ctx, verification, opts.response)
+	}
+	if opts.smtpDetails && verification.SMTPReply != nil {
+		res.SMTPCode = verification.SMTPReply.Code
+		res.SMTPMessage = verification.SMTPReply.Message
+	}
+	return res
+}
+
+// uniqueEmails returns emails without duplicates, keeping the first
+// occurrence of each.
+func uniqueEmails(emails []string) []string {
+	seen := make(map[string]bool, len(emails))
+	unique := make([]string, 0, len(emails))
+	for _, email := range emails {
+		if key := addressKey(email); !seen[key] {
+			seen[key] = true
+			unique = append(unique, email)
+		}
+	}
+	return unique
+}
+
+// classificationRank orders results for ?sort=classification: valid, then
+// risky, then invalid, then failed verifications.
+func classificationRank(res BulkVerificationResult) int {
+	if res.Result == nil || res.Result.Result == nil {
+		return 3
+	}
+	switch outcomeClass(res.Result.Result) {
+	case outcomeValid:
+		return 0
+	case outcomeUnknown:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// sortByClassification orders results by classificationRank, keeping the
+// input order within each class.
+func sortByClassification(results []BulkVerificationResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return classificationRank(results[i]) < classificationRank(results[j])
+	})
+}
+
+// keyedByEmail indexes results by email, for the ?shape=map response.
+func keyedByEmail(results []BulkVerificationResult) map[string]BulkVerificationResult {
+	keyed := make(map[string]BulkVerificationResult, len(results))
+	for _, res := range results {
+		keyed[res.Email] = res
+	}
+	return keyed
+}
+
+// InvalidBulkEmail describes an entry of a bulk request that can't be an
+// email address.
+type InvalidBulkEmail struct {
+	Index  int    `json:"index"`
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+}
+
+// invalidBulkEmails returns the entries of emails that are empty or
+// structurally impossible addresses. Subtler syntax problems are left to
+// the verification itself.
+func invalidBulkEmails(emails []string) []InvalidBulkEmail {
+	var invalid []InvalidBulkEmail
+	for i, email := range emails {
+		reason := ""
+		at := strings.LastIndex(email, "@")
+		switch {
+		case strings.TrimSpace(email) == "":
+			reason = "empty"
+		case len(email) > 254:
+			reason = "too_long"
+		case at <= 0 || at == len(email)-1:
+			reason = "missing_local_part_or_domain"
+		}
+		if reason != "" {
+			invalid = append(invalid, InvalidBulkEmail{Index: i, Email: email, Reason: reason})
+		}
+	}
+	return invalid
+}
+
+// respondWithInvalidEmails rejects a bulk request listing its malformed
+// entries.
+func respondWithInvalidEmails(w http.ResponseWriter, r *http.Request, invalid []InvalidBulkEmail) {
+	respondWithErrorDetails(w, r, http.StatusBadRequest, "Invalid emails provided, use ?lenient=true to verify them anyway", map[string]interface{}{
+		"invalid": invalid,
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBulkContextShortTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{500 * time.Millisecond, 2 * time.Second, 4 * time.Second, 25 * time.Second} {
+		parent, cancel := context.WithTimeout(context.Background(), timeout)
+		ctx, cancelBulk := bulkContext(parent)
+		deadline, _ := ctx.Deadline()
+		if left := time.Until(deadline); left < timeout/3 {
+			t.Errorf("timeout %s: bulk deadline %s away, want most of the timeout left", timeout, left)
+		}
+		cancelBulk()
+		cancel()
+	}
+}
+
+func TestBulkWithShortMaxDuration(t *testing.T) {
+	stubVerifier(t, deliverableVerification)
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/bulk", strings.NewReader(`["a@example.com", "b@example.com"]`))
+	r.Header.Set("X-Max-Duration", "1s")
+	w := httptest.NewRecorder()
+	withTimeout(BulkEmailVerification)(w, r, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d: %s", w.Code, w.Body)
+	}
+	var results []BulkVerificationResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 2 {
+		t.Errorf("got %s, want both results", w.Body)
+	}
+}
+
+func TestVerifyAllDeduplicatesByMatchKey(t *testing.T) {
+	defer func(normalize bool) { NORMALIZE_LOCAL_PART = normalize }(NORMALIZE_LOCAL_PART)
+	NORMALIZE_LOCAL_PART = true
+	for _, force := range []bool{false, true} {
+		counter := &countingVerifier{run: deliverableVerification}
+		stubVerifier(t, counter.verify)
+
+		emails := []string{"John@example.com", "john@example.com", "John@example.com", "JOHN@Example.com", "john@example.com."}
+		opts := bulkOptions{verify: verifyOptions{Force: force}}
+		outcome := verifyAll(context.Background(), sharedVerifier(), emails, len(emails), opts, nil)
+		if len(counter.calls) != 1 || counter.calls["John@example.com"] != 1 {
+			t.Errorf("force=%t: verifications = %v, want a single one", force, counter.calls)
+		}
+		if outcome.partial || len(outcome.results) != len(emails) {
+			t.Fatalf("force=%t: outcome = %+v, want every result", force, outcome)
+		}
+		for i, res := range outcome.results {
+			if res.Email != emails[i] || res.Result == nil || res.Result.Email != trimTrailingDot(emails[i]) {
+				t.Errorf("force=%t: result %d = %+v, want it for %s", force, i, res, emails[i])
+			}
+		}
+
+		// A trailing dot is answered from the cache without a slot
+		outcome = verifyAll(context.Background(), sharedVerifier(), []string{"JOHN@example.com."}, 1, bulkOptions{}, nil)
+		if outcome.cacheHits != 1 || len(counter.calls) != 1 {
+			t.Errorf("force=%t: %d cache hits, verifications = %v, want the cached result", force, outcome.cacheHits, counter.calls)
+		}
+	}
+}
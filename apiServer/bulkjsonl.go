@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// bulkJSONLMaxLine bounds a line of a POST /v1/bulk/jsonl body.
+const bulkJSONLMaxLine = 64 << 10
+
+// streamIdleTimeout is how long a streamed request, POST /v1/bulk/jsonl or
+// a job download, may go without reading or writing anything. It replaces
+// the server's read and write timeouts, which would end a large list or
+// download part way.
+const streamIdleTimeout = 30 * time.Second
+
+// BulkJSONLResult is a line of a POST /v1/bulk/jsonl response. Line is the
+// line of the request body it answers, since results are written as they
+// complete rather than in input order.
+type BulkJSONLResult struct {
+	Line int `json:"line"`
+	BulkVerificationResult
+}
+
+// bulkJSONLItem is a line of the request waiting for a worker.
+type bulkJSONLItem struct {
+	line  int
+	email string
+	opts  bulkOptions
+}
+
+// BulkJSONLVerification verifies an NDJSON body with a VerificationRequest
+// per line, answering with a BulkJSONLResult per line as each completes.
+// Neither the list nor its results are held in memory, so it takes lists
+// up to the token's job limit. Lines that can't be verified, and the line
+// past that limit, which ends the response, are answered with an error.
+func BulkJSONLVerification(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// The body is still read once the results are written
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	base := bulkOptionsFromRequest(r)
+	maxEmails := tokenConfigFrom(r.Context()).jobMaxEmails()
+	verifier := sharedVerifier()
+	items := make(chan bulkJSONLItem)
+	results := make(chan BulkJSONLResult)
+	send := func(res BulkJSONLResult) {
+		select {
+		case results <- res:
+		case <-ctx.Done():
+		}
+	}
+
+	var wg sync.WaitGroup
+	tenant := &bulkTenant{}
+	for n := 0; n < max(runtimeSettings().MaxEmails, 1); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				// Streamed lists wait for their slots like jobs
+				if bulkSlots.acquire(ctx, tenant, 0) != nil {
+					continue
+				}
+				res := verifyOne(ctx, verifier, item.email, item.opts)
+				bulkSlots.release()
+				send(BulkJSONLResult{Line: item.line, BulkVerificationResult: res})
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(items)
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 4096), bulkJSONLMaxLine)
+		line, count := 0, 0
+		for {
+			rc.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+			if !scanner.Scan() {
+				break
+			}
+			line++
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+			if count++; count > maxEmails {
+				send(BulkJSONLResult{Line: line, BulkVerificationResult: BulkVerificationResult{Error: fmt.Sprintf("Too many emails provided (max %d)", maxEmails)}})
+				return
+			}
+			item, err := parseBulkJSONLLine(r, text, base)
+			if err != nil {
+				send(BulkJSONLResult{Line: line, BulkVerificationResult: BulkVerificationResult{Email: item.email, Error: err.Error()}})
+				continue
+			}
+			item.line = line
+			select {
+			case items <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			msg := "Invalid request body"
+			if errors.Is(err, bufio.ErrTooLong) {
+				msg = fmt.Sprintf("Line too long (max %d bytes)", bulkJSONLMaxLine)
+			}
+			send(BulkJSONLResult{Line: line + 1, BulkVerificationResult: BulkVerificationResult{Error: msg}})
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	for res := range results {
+		if ctx.Err() != nil {
+			continue
+		}
+		rc.SetWriteDeadline(time.Now().Add(streamIdleTimeout))
+		if err := encoder.Encode(res); err != nil {
+			// The client is gone, stop verifying and let the workers drain
+			cancel()
+			continue
+		}
+		rc.Flush()
+	}
+}
+
+// parseBulkJSONLLine decodes a line of a POST /v1/bulk/jsonl body, with
+// its options applied over the query parameters of r as for POST /v1/verify.
+// The returned item holds the email as given even when err is set.
+func parseBulkJSONLLine(r *http.Request, text []byte, base bulkOptions) (bulkJSONLItem, error) {
+	var req VerificationRequest
+	if err := json.Unmarshal(text, &req); err != nil {
+		return bulkJSONLItem{}, errors.New("Invalid request format")
+	}
+	item := bulkJSONLItem{email: req.Email}
+	if req.Email == "" {
+		return item, errors.New("email is required")
+	}
+	email, err := addressFromInput(req.Email)
+	if err != nil {
+		return item, err
+	}
+	verify, response, err := req.options(r)
+	if err != nil {
+		return item, err
+	}
+	verify.Bulk = true
+	item.email, item.opts = email, base
+	item.opts.verify, item.opts.response = verify, response
+	return item, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+// cache holds successful verifications by email. It is disabled unless
+// CACHE_TTL or one of the per-outcome TTLs is set.
+var cache = newResultCache(cacheTTLs{})
+
+// Outcome classes with their own cache TTL, see outcomeClass
+const (
+	outcomeValid   = "valid"
+	outcomeInvalid = "invalid"
+	outcomeUnknown = "unknown"
+)
+
+// cacheTTLs are the lifetimes of cached verifications per outcome class,
+// from CACHE_TTL_VALID, CACHE_TTL_INVALID and CACHE_TTL_UNKNOWN. Confirmed
+// outcomes can be kept longer, while uncertain ones should expire soon so
+// they get another chance. A class with a zero TTL isn't cached.
+type cacheTTLs struct {
+	Valid   time.Duration
+	Invalid time.Duration
+	Unknown time.Duration
+}
+
+// of returns the TTL of the outcome class of v.
+func (t cacheTTLs) of(v *Verification) time.Duration {
+	switch outcomeClass(v.Result) {
+	case outcomeValid:
+		return t.Valid
+	case outcomeInvalid:
+		return t.Invalid
+	default:
+		return t.Unknown
+	}
+}
+
+// shortest returns the smallest of the enabled TTLs, or zero when caching is
+// disabled altogether.
+func (t cacheTTLs) shortest() time.Duration {
+	var shortest time.Duration
+	for _, ttl := range []time.Duration{t.Valid, t.Invalid, t.Unknown} {
+		if ttl > 0 && (shortest == 0 || ttl < shortest) {
+			shortest = ttl
+		}
+	}
+	return shortest
+}
+
+// outcomeClass classifies ret as confirmed valid, confirmed invalid, or
+// unknown, which covers catch-all domains and checks that got no answer.
+func outcomeClass(ret *emailVerifier.Result) string {
+	switch {
+	case !ret.Syntax.Valid, !ret.HasMxRecords && !ret.Disposable:
+		// Disposable domains aren't checked for MX records
+		return outcomeInvalid
+	case ret.Reachable == reachableYes:
+		return outcomeValid
+	case ret.Reachable == reachableNo:
+		return outcomeInvalid
+	default:
+		return outcomeUnknown
+	}
+}
+
+// resultCache is an in-memory cache of verifications that expire after the
+// TTL of their outcome class.
+type resultCache struct {
+	ttls    cacheTTLs
+	mu      sync.Mutex
+	entries map[string]*Verification
+
+	hits, misses atomic.Int64 // lookups by get while enabled
+}
+
+// newResultCache creates a cache whose entries live for the TTL of their
+// outcome class. Caching is disabled when all the TTLs are zero or less.
+func newResultCache(ttls cacheTTLs) *resultCache {
+	c := &resultCache{ttls: ttls, entries: map[string]*Verification{}}
+	if interval := ttls.shortest(); interval > 0 {
+		go c.sweep(interval)
+	}
+	return c
+}
+
+// expired reports whether v has outlived the TTL of its outcome class.
+func (c *resultCache) expired(v *Verification) bool {
+	return time.Since(v.VerifiedAt) > c.ttls.of(v)
+}
+
+// get returns the cached verification for email, if it hasn't expired,
+// counting the lookup as a hit or a miss.
+func (c *resultCache) get(email string) (*Verification, bool) {
+	v, ok := c.peek(email)
+	if c.ttls.shortest() > 0 {
+		if ok {
+			c.hits.Add(1)
+		} else {
+			c.misses.Add(1)
+		}
+	}
+	return v, ok
+}
+
+// peek is get without counting the lookup.
+func (c *resultCache) peek(email string) (*Verification, bool) {
+	if c.ttls.shortest() <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.entries[email]
+	if !ok || c.expired(v) {
+		return nil, false
+	}
+	return v, true
+}
+
+// set caches v under email, unless its outcome class isn't cached. Cached
+// verifications are shared between requests and must not be modified
+// afterwards.
+func (c *resultCache) set(email string, v *Verification) {
+	if c.ttls.of(v) <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.entries[email] = v
+	c.mu.Unlock()
+}
+
+// remove drops the verifications of email under every combination of
+// options, returning how many there were.
+func (c *resultCache) remove(email string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key := range c.entries {
+		if key == email || strings.HasPrefix(key, email+"|") {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// flush drops every entry, returning how many there were.
+func (c *resultCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flushed := len(c.entries)
+	c.entries = map[string]*Verification{}
+	return flushed
+}
+
+// sweep drops expired entries every interval so the cache doesn't grow
+// without bound.
+func (c *resultCache) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.mu.Lock()
+		for email, v := range c.entries {
+			if c.expired(v) {
+				delete(c.entries, email)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// cacheEntry is a cached verification with the options it was made with.
+type cacheEntry struct {
+	email        string
+	options      string // empty for the default options, see cacheKey
+	verification *Verification
+}
+
+// snapshot returns the unexpired entries, most recently verified first.
+func (c *resultCache) snapshot() []cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]cacheEntry, 0, len(c.entries))
+	for key, v := range c.entries {
+		if c.expired(v) {
+			continue
+		}
+		email, options, _ := strings.Cut(key, "|")
+		entries = append(entries, cacheEntry{email: email, options: options, verification: v})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].verification.VerifiedAt.After(entries[j].verification.VerifiedAt)
+	})
+	return entries
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// CACHE_ADMIN_TOKEN enables DELETE /v1/cache/:email and POST
+// /v1/cache/flush, which only accept it as their Authorization header, so
+// the API tokens can't purge the results other clients rely on. Unset,
+// the cache can only be inspected.
+var CACHE_ADMIN_TOKEN string
+
+// CacheStats describes the result cache.
+type CacheStats struct {
+	Enabled bool    `json:"enabled"`
+	Size    int     `json:"size"`     // unexpired verifications
+	Hits    int64   `json:"hits"`     // lookups answered from the cache since startup
+	Misses  int64   `json:"misses"`   // lookups that had to verify
+	HitRate float64 `json:"hit_rate"` // hits over all lookups, 0 before the first one
+}
+
+// CacheChangeResponse is the outcome of a cache purge.
+type CacheChangeResponse struct {
+	Removed int `json:"removed"` // verifications dropped
+}
+
+// GetCacheStats returns the size and hit rate of the result cache.
+func GetCacheStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	stats := CacheStats{
+		Enabled: cache.ttls.shortest() > 0,
+		Size:    len(cache.snapshot()),
+		Hits:    cache.hits.Load(),
+		Misses:  cache.misses.Load(),
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(lookups)
+	}
+	respondWithJSON(w, r, http.StatusOK, stats)
+}
+
+// DeleteCachedEmail drops the cached verifications of an email, made with
+// any options, so its next verification is fresh.
+func DeleteCachedEmail(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	email := emailParam(ps)
+	if email == "" {
+		respondWithError(w, r, http.StatusBadRequest, "email is required")
+		return
+	}
+	removed := cache.remove(addressKey(email))
+	log.Printf("Cache: %d verifications of %s removed", removed, email)
+	respondWithJSON(w, r, http.StatusOK, CacheChangeResponse{Removed: removed})
+}
+
+// FlushCache drops every cached verification.
+func FlushCache(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	removed := cache.flush()
+	log.Printf("Cache: flushed, %d verifications removed", removed)
+	respondWithJSON(w, r, http.StatusOK, CacheChangeResponse{Removed: removed})
+}
+
+// verifyAdminToken only lets requests authorized with CACHE_ADMIN_TOKEN
+// through.
+func verifyAdminToken(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		authToken := r.Header.Get("Authorization")
+		if authToken == "" {
+			respondWithTextError(w, r, http.StatusUnauthorized, "Authorization token is required")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(authToken), []byte(CACHE_ADMIN_TOKEN)) != 1 {
+			respondWithTextError(w, r, http.StatusForbidden, "Invalid authorization token")
+			return
+		}
+		next(w, r, ps)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import emailVerifier "github.com/AfterShip/email-verifier"
+
+// Confidence that an address is deliverable, from 0 to 1. SMTP answers are
+// the strongest signal but never certain: servers may accept at RCPT TO
+// and bounce later, or reject a probe they would accept a message for.
+//
+//	invalid syntax or no MX records          0
+//	rejected at RCPT TO                       0.05
+//	mailbox full                              0.1
+//	no SMTP answer (skipped, timed out)       0.2
+//	catch-all domain                          0.5
+//	accepted at RCPT TO                       0.95
+const (
+	confidenceNone      = 0
+	confidenceRejected  = 0.05
+	confidenceFullInbox = 0.1
+	confidenceNoAnswer  = 0.2
+	confidenceCatchAll  = 0.5
+	confidenceAccepted  = 0.95
+)
+
+// confidence scores ret by the table above.
+func confidence(ret *emailVerifier.Result) float64 {
+	switch {
+	case !ret.Syntax.Valid:
+		return confidenceNone
+	case ret.SMTP == nil && !ret.Disposable && !ret.HasMxRecords:
+		// Disposable domains aren't checked for MX records
+		return confidenceNone
+	case ret.SMTP == nil:
+		return confidenceNoAnswer
+	case ret.SMTP.Deliverable:
+		return confidenceAccepted
+	case ret.SMTP.HostExists && ret.SMTP.CatchAll:
+		return confidenceCatchAll
+	case ret.SMTP.FullInbox:
+		return confidenceFullInbox
+	default:
+		return confidenceRejected
+	}
+}
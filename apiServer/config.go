@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// EffectiveConfig is the non-secret configuration the server is running
+// with. It must never include AUTH_TOKEN, FROM_EMAIL or proxy URLs, which
+// may carry credentials.
+type EffectiveConfig struct {
+	MaxEmails            int     `json:"max_emails"`
+	BulkConcurrency      int     `json:"bulk_concurrency"`
+	JobConcurrency       int     `json:"job_concurrency"`
+	MaxQueueWait         string  `json:"max_queue_wait"`
+	RequestTimeout       string  `json:"request_timeout"`
+	MinResponseTime      string  `json:"min_response_time"`
+	CacheTTLValid        string  `json:"cache_ttl_valid"`
+	CacheTTLInvalid      string  `json:"cache_ttl_invalid"`
+	CacheTTLUnknown      string  `json:"cache_ttl_unknown"`
+	SMTPEnabled          bool    `json:"smtp_enabled"`
+	SkipSMTPForFree      bool    `json:"skip_smtp_for_free"`
+	GravatarEnabled      bool    `json:"gravatar_enabled"`
+	SMTPConnectTimeout   string  `json:"smtp_connect_timeout"`
+	SMTPOperationTimeout string  `json:"smtp_operation_timeout"`
+	SMTPCommandDelay     string  `json:"smtp_command_delay"`
+	SMTPJitterMax        string  `json:"smtp_jitter_max"`
+	SMTPEmptySender      bool    `json:"smtp_empty_sender"`
+	MXTryLimit           int     `json:"mx_try_limit"`
+	RejectPrivateMX      bool    `json:"reject_private_mx"`
+	SMTPStartTLS         bool    `json:"smtp_starttls"`
+	SMTPTLSInsecure      bool    `json:"smtp_tls_insecure"`
+	EmailTotalBudget     string  `json:"email_total_budget"`
+	SMTPBreakerThreshold int     `json:"smtp_breaker_threshold"`
+	SMTPBreakerCooldown  string  `json:"smtp_breaker_cooldown"`
+	IPNetwork            string  `json:"ip_network"`
+	SyntaxMode           string  `json:"syntax_mode"`
+	ResultStatusMode     string  `json:"result_status_mode"`
+	CheckTLD             bool    `json:"check_tld"`
+	NormalizeLocalPart   bool    `json:"normalize_local_part"`
+	NormalizeUnicode     bool    `json:"normalize_unicode"`
+	HomographCheck       bool    `json:"homograph_check"`
+	RejectRoleAccounts   bool    `json:"reject_role_accounts"`
+	ProxyCount           int     `json:"proxy_count"`
+	ProxyMaxConcurrency  int     `json:"proxy_max_concurrency"`
+	SenderOverrides      bool    `json:"sender_overrides"`
+	TokenCount           int     `json:"token_count"` // tokens in TOKENS_CONFIG
+	JobMaxEmails         int     `json:"job_max_emails"`
+	MaxDisposableEmails  int     `json:"max_disposable_emails"`
+	JobInlineMaxBytes    int     `json:"job_inline_max_bytes"`
+	JobTTL               string  `json:"job_ttl"`
+	JobOutputDir         string  `json:"job_output_dir,omitempty"`
+	DebugSampleRate      float64 `json:"debug_sample_rate"`
+	LogRedactEmails      bool    `json:"log_redact_emails"`
+	DebugEndpoints       bool    `json:"debug_endpoints"`
+	ResponseEnvelope     bool    `json:"response_envelope"`
+	DomainReputationTTL  string  `json:"domain_reputation_ttl"`
+	CatchAllCacheTTL     string  `json:"catch_all_cache_ttl"`
+	DNSCacheTTL          string  `json:"dns_cache_ttl"`
+	DNSConcurrency       int     `json:"dns_concurrency"`
+	DNSRetryCount        int     `json:"dns_retry_count"`
+	DNSRetryBackoff      string  `json:"dns_retry_backoff"`
+	GravatarConcurrency  int     `json:"gravatar_concurrency"`
+	GravatarCacheTTL     string  `json:"gravatar_cache_ttl"`
+
+	DegradeOrder []string `json:"degrade_order"`
+
+	AbuseTracking  bool    `json:"abuse_tracking"` // whether ABUSE_WEBHOOK_URL is set
+	AbuseThreshold float64 `json:"abuse_threshold"`
+	AbuseMinEmails int     `json:"abuse_min_emails"`
+	AbuseWindow    string  `json:"abuse_window"`
+
+	ClassificationRules int `json:"classification_rules"` // rules in CLASSIFICATION_RULES
+
+	Broker      string `json:"broker,omitempty"` // scheme of BROKER_URL, which may carry credentials
+	BrokerTopic string `json:"broker_topic,omitempty"`
+
+	ResultStore        bool   `json:"result_store"` // whether DATABASE_URL is set
+	StoreBuffer        int    `json:"store_buffer"`
+	StoreBatchSize     int    `json:"store_batch_size"`
+	StoreFlushInterval string `json:"store_flush_interval"`
+
+	BulkSyncDeadline string `json:"bulk_sync_deadline"`
+
+	SubaddressSeparators map[string]string `json:"subaddress_separators"`
+
+	DomainAgeCacheTTL string `json:"domain_age_cache_ttl"`
+	YoungDomainDays   int    `json:"young_domain_days"`
+
+	MaxHeaderBytes int  `json:"max_header_bytes"`
+	HTTPKeepAlives bool `json:"http_keep_alives"`
+
+	ProxyMXMaxConcurrency int `json:"proxy_mx_max_concurrency"`
+
+	HeloNames []string `json:"helo_names"` // tried in order, see HELO_NAMES
+
+	InternalDomains []string `json:"internal_domains,omitempty"`
+
+	CacheAdmin bool `json:"cache_admin"` // whether CACHE_ADMIN_TOKEN is set
+
+	HTTPTimeout             string `json:"http_timeout"` // of outbound requests
+	HTTPMaxIdleConnsPerHost int    `json:"http_max_idle_conns_per_host"`
+	HTTPIdleConnTimeout     string `json:"http_idle_conn_timeout"`
+
+	TLS             bool     `json:"tls"` // whether HTTPS is served directly
+	TLSMinVersion   string   `json:"tls_min_version,omitempty"`
+	TLSCipherSuites []string `json:"tls_cipher_suites,omitempty"`
+}
+
+func effectiveConfig() EffectiveConfig {
+	probe := sharedVerifier().smtp
+	settings := runtimeSettings()
+	config := EffectiveConfig{
+		MaxEmails:            settings.MaxEmails,
+		BulkConcurrency:      BULK_CONCURRENCY,
+		JobConcurrency:       JOB_CONCURRENCY,
+		MaxQueueWait:         MAX_QUEUE_WAIT.String(),
+		RequestTimeout:       REQUEST_TIMEOUT.String(),
+		MinResponseTime:      MIN_RESPONSE_TIME.String(),
+		CacheTTLValid:        cache.ttls.Valid.String(),
+		CacheTTLInvalid:      cache.ttls.Invalid.String(),
+		CacheTTLUnknown:      cache.ttls.Unknown.String(),
+		SMTPEnabled:          defaultVerifyOptions.SMTP && !(REQUIRE_PROXY && len(proxies.proxies) == 0),
+		SkipSMTPForFree:      SKIP_SMTP_FOR_FREE,
+		GravatarEnabled:      defaultVerifyOptions.Gravatar,
+		SMTPConnectTimeout:   probe.connectTimeout.String(),
+		SMTPOperationTimeout: probe.operationTimeout.String(),
+		SMTPCommandDelay:     probe.commandDelay.String(),
+		SMTPJitterMax:        SMTP_JITTER_MAX.String(),
+		SMTPEmptySender:      SMTP_EMPTY_SENDER,
+		MXTryLimit:           probe.mxTryLimit,
+		RejectPrivateMX:      REJECT_PRIVATE_MX,
+		SMTPStartTLS:         probe.startTLS,
+		SMTPTLSInsecure:      probe.tlsInsecure,
+		EmailTotalBudget:     EMAIL_TOTAL_BUDGET.String(),
+		SMTPBreakerThreshold: SMTP_BREAKER_THRESHOLD,
+		SMTPBreakerCooldown:  SMTP_BREAKER_COOLDOWN.String(),
+		IPNetwork:            probe.network,
+		SyntaxMode:           SYNTAX_MODE,
+		ResultStatusMode:     RESULT_STATUS_MODE,
+		CheckTLD:             CHECK_TLD,
+		NormalizeLocalPart:   NORMALIZE_LOCAL_PART,
+		NormalizeUnicode:     NORMALIZE_UNICODE,
+		HomographCheck:       HOMOGRAPH_CHECK,
+		RejectRoleAccounts:   REJECT_ROLE_ACCOUNTS,
+		ProxyCount:           len(proxies.proxies),
+		ProxyMaxConcurrency:  proxies.maxConcurrency,
+		TokenCount:           len(tokens),
+		SenderOverrides:      len(settings.AllowedFromEmails) > 0 || len(settings.AllowedHeloNames) > 0,
+		JobMaxEmails:         settings.JobMaxEmails,
+		MaxDisposableEmails:  settings.MaxDisposableEmails,
+		JobInlineMaxBytes:    JOB_INLINE_MAX_BYTES,
+		JobTTL:               JOB_TTL.String(),
+		JobOutputDir:         JOB_OUTPUT_DIR,
+		DebugSampleRate:      settings.DebugSampleRate,
+		LogRedactEmails:      LOG_REDACT_EMAILS,
+		DebugEndpoints:       DEBUG_ENDPOINTS,
+		ResponseEnvelope:     RESPONSE_ENVELOPE,
+		DomainReputationTTL:  DOMAIN_REPUTATION_TTL.String(),
+		CatchAllCacheTTL:     CATCH_ALL_CACHE_TTL.String(),
+		DNSCacheTTL:          resolver.ttl.String(),
+		DNSConcurrency:       cap(resolver.slots),
+		DNSRetryCount:        DNS_RETRY_COUNT,
+		DNSRetryBackoff:      DNS_RETRY_BACKOFF.String(),
+		GravatarConcurrency:  cap(gravatars.slots),
+		GravatarCacheTTL:     gravatars.ttl.String(),
+
+		DegradeOrder: DEGRADE_ORDER,
+
+		AbuseTracking:  ABUSE_WEBHOOK_URL != "",
+		AbuseThreshold: ABUSE_THRESHOLD,
+		AbuseMinEmails: ABUSE_MIN_EMAILS,
+		AbuseWindow:    ABUSE_WINDOW.String(),
+
+		ClassificationRules: len(classificationRules),
+
+		ResultStore:        DATABASE_URL != "",
+		StoreBuffer:        STORE_BUFFER,
+		StoreBatchSize:     STORE_BATCH_SIZE,
+		StoreFlushInterval: STORE_FLUSH_INTERVAL.String(),
+
+		BulkSyncDeadline: BULK_SYNC_DEADLINE.String(),
+
+		SubaddressSeparators: subaddressSeparators,
+
+		DomainAgeCacheTTL: DOMAIN_AGE_CACHE_TTL.String(),
+		YoungDomainDays:   YOUNG_DOMAIN_DAYS,
+
+		MaxHeaderBytes: MAX_HEADER_BYTES,
+		HTTPKeepAlives: HTTP_KEEP_ALIVES,
+
+		ProxyMXMaxConcurrency: proxyMXSlots.max,
+
+		HeloNames: probe.heloNames,
+
+		InternalDomains: INTERNAL_DOMAINS,
+
+		CacheAdmin: CACHE_ADMIN_TOKEN != "",
+
+		HTTPTimeout:             httpClient.Timeout.String(),
+		HTTPMaxIdleConnsPerHost: HTTP_MAX_IDLE_CONNS_PER_HOST,
+		HTTPIdleConnTimeout:     HTTP_IDLE_CONN_TIMEOUT.String(),
+	}
+	if u, err := url.Parse(BROKER_URL); err == nil && BROKER_URL != "" {
+		config.Broker = u.Scheme
+		config.BrokerTopic = BROKER_TOPIC
+	}
+	if TLS_CERT_FILE != "" {
+		config.TLS = true
+		config.TLSMinVersion = tlsVersionName(TLS_MIN_VERSION)
+		for _, id := range TLS_CIPHER_SUITES {
+			config.TLSCipherSuites = append(config.TLSCipherSuites, tls.CipherSuiteName(id))
+		}
+	}
+	return config
+}
+
+// GetConfig returns the effective non-secret configuration
+func GetConfig(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	respondWithJSON(w, r, http.StatusOK, effectiveConfig())
+}
+
+// envDuration returns the duration stored in the named environment variable,
+// or def when the variable is unset or not a valid duration.
+func envDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %s", key, value, def)
+		return def
+	}
+	return d
+}
+
+// envInt returns the integer stored in the named environment variable, or
+// def when the variable is unset or not a valid integer.
+func envInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %d", key, value, def)
+		return def
+	}
+	return n
+}
+
+// envList returns the comma-separated values stored in the named environment
+// variable, with surrounding whitespace and empty entries removed.
+func envList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// envFloat returns the float stored in the named environment variable, or
+// def when the variable is unset or not a valid number.
+func envFloat(key string, def float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %g", key, value, def)
+		return def
+	}
+	return f
+}
+
+// envBool returns the boolean stored in the named environment variable, or
+// def when the variable is unset or not a valid boolean.
+func envBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %t", key, value, def)
+		return def
+	}
+	return b
+}
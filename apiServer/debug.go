@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type debugTraceKey struct{}
+
+// withDebugSampling marks a DEBUG_SAMPLE_RATE fraction of requests, between
+// 0 and 1, for detailed logging. Sampled requests get a trace ID that prefixes each of
+// their debug lines.
+func withDebugSampling(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if rate := runtimeSettings().DebugSampleRate; rate > 0 && rand.Float64() < rate {
+			traceID := fmt.Sprintf("%08x", rand.Uint32())
+			r = r.WithContext(context.WithValue(r.Context(), debugTraceKey{}, traceID))
+			debugf(r.Context(), "%s %s", r.Method, r.URL.Path)
+		}
+		next(w, r, ps)
+	}
+}
+
+// debugf logs a detailed step of a sampled request, and does nothing for
+// requests that weren't sampled.
+func debugf(ctx context.Context, format string, args ...interface{}) {
+	traceID, ok := ctx.Value(debugTraceKey{}).(string)
+	if !ok {
+		return
+	}
+	log.Printf("[debug %s] %s", traceID, fmt.Sprintf(format, args...))
+}
+
+// DEBUG_ENDPOINTS registers the /debug/ endpoints, which expose cached
+// addresses and must stay off in production.
+var DEBUG_ENDPOINTS bool
+
+// DebugCacheEntry describes a cached verification, without the SMTP replies
+// or sender identities it was made with.
+type DebugCacheEntry struct {
+	Email      string   `json:"email"`
+	Options    string   `json:"options,omitempty"` // non-default checks, empty for the defaults
+	Reachable  string   `json:"reachable"`
+	Valid      bool     `json:"valid"`
+	Disposable bool     `json:"disposable"`
+	CatchAll   bool     `json:"catch_all"`
+	VerifiedAt string   `json:"verified_at"`
+	AgeSeconds int64    `json:"age_seconds"`
+	Notes      []string `json:"notes,omitempty"`
+}
+
+// GetDebugCache lists the cached verifications, most recent first, up to
+// ?limit entries (100 by default).
+func GetDebugCache(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	snapshot := cache.snapshot()
+	entries := make([]DebugCacheEntry, 0, min(limit, len(snapshot)))
+	for _, entry := range snapshot[:min(limit, len(snapshot))] {
+		v := entry.verification
+		// Options may carry per-request sender overrides
+		options, _, _ := strings.Cut(entry.options, ",from=")
+		entries = append(entries, DebugCacheEntry{
+			Email:      entry.email,
+			Options:    options,
+			Reachable:  v.Result.Reachable,
+			Valid:      v.Result.Syntax.Valid,
+			Disposable: v.Result.Disposable,
+			CatchAll:   v.Result.SMTP != nil && v.Result.SMTP.CatchAll,
+			VerifiedAt: v.VerifiedAt.UTC().Format(time.RFC3339),
+			AgeSeconds: int64(time.Since(v.VerifiedAt).Seconds()),
+			Notes:      v.Notes,
+		})
+	}
+	respondWithJSON(w, r, http.StatusOK, map[string]interface{}{
+		"ttl": map[string]string{
+			outcomeValid:   cache.ttls.Valid.String(),
+			outcomeInvalid: cache.ttls.Invalid.String(),
+			outcomeUnknown: cache.ttls.Unknown.String(),
+		},
+		"size":    len(snapshot),
+		"entries": entries,
+	})
+}
+
+// DebugSMTPResponse is the outcome of connecting to an SMTP host.
+type DebugSMTPResponse struct {
+	Host       string `json:"host"`
+	Port       string `json:"port"`
+	Proxy      string `json:"proxy,omitempty"` // without its credentials
+	Connected  bool   `json:"connected"`
+	BannerCode int    `json:"banner_code,omitempty"`
+	Banner     string `json:"banner,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// GetDebugSMTP connects to ?host on ?port (25 by default) the way SMTP
+// checks do, through the next proxy of the pool, and reports the banner the
+// server greets with. No command is sent.
+func GetDebugSMTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		respondWithError(w, r, http.StatusBadRequest, "host is required")
+		return
+	}
+	port := r.URL.Query().Get("port")
+	if port == "" {
+		port = smtpPort
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		respondWithError(w, r, http.StatusBadRequest, "port must be between 1 and 65535")
+		return
+	}
+
+	probe := sharedVerifier().smtp
+	proxyURL, release, err := probe.proxies.acquire(r.Context())
+	if err != nil {
+		respondWithError(w, r, http.StatusServiceUnavailable, "Timed out waiting for a proxy")
+		return
+	}
+	defer release()
+	resp := DebugSMTPResponse{Host: host, Port: port}
+	if proxyURL != "" {
+		resp.Proxy = redactURL(proxyURL)
+	}
+
+	start := time.Now()
+	conn, err := probe.dialConn(r.Context(), host, port, proxyURL)
+	if err == nil {
+		resp.Connected = true
+		resp.BannerCode, resp.Banner, err = textproto.NewConn(conn).ReadResponse(220)
+		conn.Close()
+	}
+	resp.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	respondWithJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/sony/gobreaker"
+)
+
+// DEGRADE_ORDER lists the optional checks to drop under pressure, first to
+// go first, such as "gravatar,smtp". A listed check is also dropped rather
+// than failing the verification when its upstream errors. Empty by
+// default, so checks are never degraded.
+var DEGRADE_ORDER []string
+
+// noteDegradedPrefix starts the notes of checks dropped by DEGRADE_ORDER,
+// as in "degraded_gravatar".
+const noteDegradedPrefix = "degraded_"
+
+// parseDegradeOrder validates the checks of a DEGRADE_ORDER value.
+func parseDegradeOrder(checks []string) ([]string, error) {
+	for i, check := range checks {
+		if check != checkSMTP && check != checkGravatar && check != checkSuggest {
+			return nil, fmt.Errorf("DEGRADE_ORDER: unknown check %q", check)
+		}
+		if slices.Contains(checks[:i], check) {
+			return nil, fmt.Errorf("DEGRADE_ORDER: %q listed twice", check)
+		}
+	}
+	return checks, nil
+}
+
+// degradeLevel is how many checks of DEGRADE_ORDER are dropped right now.
+// One is dropped for each full round of BULK_CONCURRENCY verifications
+// queued for a slot, and while the SMTP breaker isn't closed every check up
+// to smtp is, since SMTP checks would be short-circuited anyway.
+func degradeLevel() int {
+	level := 0
+	if bulkSlots != nil {
+		backlog, slots := bulkSlots.backlog()
+		level = (backlog + slots - 1) / slots
+	}
+	if smtpBreaker != nil && smtpBreaker.State() != gobreaker.StateClosed {
+		if i := slices.Index(DEGRADE_ORDER, checkSMTP); i >= 0 {
+			level = max(level, i+1)
+		}
+	}
+	return min(level, len(DEGRADE_ORDER))
+}
+
+// degrade turns off the checks of opts dropped at the current level and
+// returns the notes reporting them.
+func degrade(opts verifyOptions) (verifyOptions, []string) {
+	var notes []string
+	for _, check := range DEGRADE_ORDER[:degradeLevel()] {
+		if enabled := opts.check(check); *enabled {
+			*enabled = false
+			notes = append(notes, noteDegradedPrefix+check)
+		}
+	}
+	return opts, notes
+}
+
+// degradable reports whether a failure of check drops it instead of
+// failing the verification.
+func degradable(check string) bool {
+	return slices.Contains(DEGRADE_ORDER, check)
+}
+
+// check returns the toggle of one of the optional checks.
+func (o *verifyOptions) check(name string) *bool {
+	switch name {
+	case checkSMTP:
+		return &o.SMTP
+	case checkGravatar:
+		return &o.Gravatar
+	default:
+		return &o.Suggest
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+// REJECT_ROLE_ACCOUNTS makes role accounts such as info@ or admin@
+// undeliverable in the default policy, which suits signup forms that want
+// a person behind each address. role_account is reported either way.
+// Requests override it with ?reject_role_accounts=true or false.
+var REJECT_ROLE_ACCOUNTS = true
+
+// deliverabilityPolicy decides the top-level "deliverable" verdict. The
+// strict policy requires an address to pass every check; individual checks
+// can be relaxed per request with ?relax=mx,disposable,role_account,catch_all,smtp.
+// Syntax can never be relaxed.
+type deliverabilityPolicy struct {
+	requireMX        bool
+	rejectDisposable bool
+	rejectRole       bool
+	rejectCatchAll   bool
+	requireSMTP      bool // SMTP must confirm the mailbox
+}
+
+func strictPolicy() deliverabilityPolicy {
+	return deliverabilityPolicy{
+		requireMX:        true,
+		rejectDisposable: true,
+		rejectRole:       REJECT_ROLE_ACCOUNTS,
+		rejectCatchAll:   true,
+		requireSMTP:      true,
+	}
+}
+
+// policyFromRequest returns the strict policy with the checks listed in the
+// relax query parameter turned off, and role accounts rejected as
+// ?reject_role_accounts says.
+func policyFromRequest(r *http.Request) deliverabilityPolicy {
+	policy := strictPolicy()
+	switch r.URL.Query().Get("reject_role_accounts") {
+	case "true":
+		policy.rejectRole = true
+	case "false":
+		policy.rejectRole = false
+	}
+	for _, check := range strings.Split(r.URL.Query().Get("relax"), ",") {
+		switch strings.TrimSpace(check) {
+		case "mx":
+			policy.requireMX = false
+		case "disposable":
+			policy.rejectDisposable = false
+		case "role_account":
+			policy.rejectRole = false
+		case "catch_all":
+			policy.rejectCatchAll = false
+		case "smtp":
+			policy.requireSMTP = false
+		}
+	}
+	return policy
+}
+
+// Reasons an address fails the policy, reported in the response's reasons.
+const (
+	reasonSyntaxInvalid   = "syntax_invalid"
+	reasonNoMX            = "no_mx_records"
+	reasonDisposable      = "disposable_domain"
+	reasonRoleAccount     = "role_account"
+	reasonCatchAll        = "catch_all"
+	reasonSMTPUnverified  = "smtp_unverified"  // no SMTP answer, the check was skipped or failed
+	reasonSMTPUnreachable = "smtp_unreachable" // no mail server accepted the connection
+	reasonSMTPRejected    = "smtp_rejected"    // the server rejected the address at RCPT TO
+	reasonMailboxFull     = "mailbox_full"     // rejected because the mailbox is full
+	reasonMailboxDisabled = "mailbox_disabled" // rejected because the mailbox is disabled
+)
+
+// deliverable reports whether ret passes the policy.
+func (p deliverabilityPolicy) deliverable(ret *emailVerifier.Result) bool {
+	return len(p.reasons(ret)) == 0
+}
+
+// reasons lists every check of the policy ret fails, none when it is
+// deliverable. An invalid syntax is the only reason given, since the other
+// checks don't apply to such addresses.
+func (p deliverabilityPolicy) reasons(ret *emailVerifier.Result) []string {
+	if !ret.Syntax.Valid {
+		return []string{reasonSyntaxInvalid}
+	}
+	var reasons []string
+	if p.requireMX && !ret.HasMxRecords {
+		reasons = append(reasons, reasonNoMX)
+	}
+	if p.rejectDisposable && ret.Disposable {
+		reasons = append(reasons, reasonDisposable)
+	}
+	if p.rejectRole && ret.RoleAccount {
+		reasons = append(reasons, reasonRoleAccount)
+	}
+
+	catchAll := ret.SMTP != nil && ret.SMTP.CatchAll
+	if p.rejectCatchAll && catchAll {
+		reasons = append(reasons, reasonCatchAll)
+	}
+	// A catch-all server accepts every address, which is good enough once
+	// catch-all domains are allowed, and is already a reason otherwise
+	if p.requireSMTP && !catchAll {
+		switch {
+		case ret.SMTP == nil:
+			reasons = append(reasons, reasonSMTPUnverified)
+		case ret.SMTP.Deliverable:
+		case !ret.SMTP.HostExists:
+			reasons = append(reasons, reasonSMTPUnreachable)
+		case ret.SMTP.FullInbox:
+			reasons = append(reasons, reasonMailboxFull)
+		case ret.SMTP.Disabled:
+			reasons = append(reasons, reasonMailboxDisabled)
+		default:
+			reasons = append(reasons, reasonSMTPRejected)
+		}
+	}
+	return reasons
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// DisposableResult is one entry of a POST /v1/bulk/disposable response.
+type DisposableResult struct {
+	Email      string `json:"email"`
+	Disposable bool   `json:"disposable"`
+}
+
+// isDisposable reports whether domain belongs to a disposable email
+// provider, by the library's list or DISPOSABLE_DOMAINS.
+func (v *Verifier) isDisposable(domain string) bool {
+	return v.checks.IsDisposable(domain) || runtimeSettings().DisposableDomains[domain]
+}
+
+// BulkDisposableCheck flags the disposable addresses of a list, accepting
+// the same shapes as the bulk endpoint. Only the disposable check runs, no
+// network work, so a request may hold up to MAX_DISPOSABLE_EMAILS emails.
+// Emails with invalid syntax are reported as not disposable.
+func BulkDisposableCheck(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req, err := decodeBulkRequest(r.Body)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Emails) == 0 {
+		respondWithError(w, r, http.StatusBadRequest, "No emails provided")
+		return
+	}
+	if maxEmails := runtimeSettings().MaxDisposableEmails; len(req.Emails) > maxEmails {
+		respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("Too many emails provided (max %d)", maxEmails))
+		return
+	}
+
+	verifier := sharedVerifier()
+	results := make([]DisposableResult, len(req.Emails))
+	for i, email := range req.Emails {
+		results[i].Email = email
+		if syntax := verifier.checks.ParseAddress(email); syntax.Valid {
+			results[i].Disposable = verifier.isDisposable(syntax.Domain)
+		}
+	}
+	respondWithJSON(w, r, http.StatusOK, results)
+}
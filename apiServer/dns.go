@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	// DNS_CACHE_TTL is how long MX lookups are cached. Zero disables the
+	// cache, concurrent lookups of a domain are still merged.
+	DNS_CACHE_TTL time.Duration
+	// DNS_CONCURRENCY caps the MX lookups in flight, unlimited when zero.
+	DNS_CONCURRENCY = 0
+	// DNS_RETRY_COUNT is how many times an MX lookup that timed out or got
+	// a temporary failure such as SERVFAIL is retried, waiting
+	// DNS_RETRY_BACKOFF before the first retry and twice as long before
+	// each next one. Domains that don't exist aren't retried.
+	DNS_RETRY_COUNT   = 0
+	DNS_RETRY_BACKOFF = 100 * time.Millisecond
+)
+
+// resolver performs the MX lookups of the MX and SMTP checks.
+var resolver = newMXResolver(DNS_CONCURRENCY, DNS_CACHE_TTL)
+
+// mxResolver merges concurrent MX lookups of the same domain into a single
+// query, so bulk lists with many addresses at one domain don't repeat it,
+// and caches the answers for ttl.
+type mxResolver struct {
+	group singleflight.Group
+	slots chan struct{} // nil when unlimited
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]mxEntry
+}
+
+type mxEntry struct {
+	records    []*net.MX
+	ttl        time.Duration // lowest TTL of the records, -1 when unknown
+	err        error
+	resolvedAt time.Time
+}
+
+// remaining returns how much of the records' TTL is left, or -1 when it
+// isn't known.
+func (e mxEntry) remaining() time.Duration {
+	if e.ttl < 0 {
+		return -1
+	}
+	return max(0, e.ttl-time.Since(e.resolvedAt))
+}
+
+func newMXResolver(concurrency int, ttl time.Duration) *mxResolver {
+	r := &mxResolver{ttl: ttl, cache: map[string]mxEntry{}}
+	if concurrency > 0 {
+		r.slots = make(chan struct{}, concurrency)
+	}
+	return r
+}
+
+// lookupMX returns the MX records of the ASCII domain sorted by
+// preference, like net.LookupMX, with what is left of their lowest TTL, or
+// -1 when it isn't known. The records are shared and must not be modified.
+// Waiting for the answer stops when ctx ends, the query itself keeps going
+// for the other callers, for at most queryMXTimeout.
+func (r *mxResolver) lookupMX(ctx context.Context, domain string) ([]*net.MX, time.Duration, error) {
+	if entry, ok := r.cached(domain); ok {
+		return entry.records, entry.remaining(), entry.err
+	}
+
+	answer := r.group.DoChan(domain, func() (interface{}, error) {
+		if r.slots != nil {
+			r.slots <- struct{}{}
+			defer func() { <-r.slots }()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), queryMXTimeout())
+		defer cancel()
+		entry := queryMX(ctx, domain)
+		r.store(domain, entry)
+		return entry, entry.err
+	})
+	select {
+	case res := <-answer:
+		entry, _ := res.Val.(mxEntry)
+		return entry.records, entry.remaining(), res.Err
+	case <-ctx.Done():
+		return nil, -1, ctx.Err()
+	}
+}
+
+// queryMX looks up the MX records of domain, retrying transient failures
+// DNS_RETRY_COUNT times, until ctx is done.
+func queryMX(ctx context.Context, domain string) mxEntry {
+	backoff := DNS_RETRY_BACKOFF
+	for attempt := 0; ; attempt++ {
+		entry := queryMXOnce(ctx, domain)
+		if !transientDNSError(entry.err) || attempt >= DNS_RETRY_COUNT {
+			return entry
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return entry
+		}
+		backoff *= 2
+	}
+}
+
+// queryMXTimeout bounds queryMX by the timeouts of its attempts and the
+// backoffs between them. Each attempt queries the nameservers of
+// resolvConf once, then the system resolver, which tries each of them
+// Attempts times.
+func queryMXTimeout() time.Duration {
+	resolvConfOnce.Do(loadResolvConf)
+	// The system resolver's defaults when resolv.conf can't be read
+	timeout, servers, attempts := 5*time.Second, 1, 2
+	if config := resolvConf.Load(); config != nil && len(config.Servers) > 0 {
+		timeout, servers, attempts = time.Duration(config.Timeout)*time.Second, len(config.Servers), config.Attempts
+	}
+	total := timeout * time.Duration(servers*(1+attempts)) * time.Duration(DNS_RETRY_COUNT+1)
+	for backoff, n := DNS_RETRY_BACKOFF, 0; n < DNS_RETRY_COUNT; n++ {
+		total += backoff
+		backoff *= 2
+	}
+	return total
+}
+
+// queryMXOnce looks up the MX records of domain. The system resolver hides
+// the TTLs, so the query goes to the nameservers of /etc/resolv.conf
+// directly, falling back to the system resolver without a TTL when they
+// can't be read or don't answer.
+func queryMXOnce(ctx context.Context, domain string) mxEntry {
+	if entry, ok := exchangeMX(ctx, domain); ok {
+		return entry
+	}
+	records, err := net.DefaultResolver.LookupMX(ctx, domain)
+	return mxEntry{records: records, ttl: -1, err: err, resolvedAt: time.Now()}
+}
+
+// transientDNSError reports whether err is a lookup failure that may not
+// happen again, unlike an answer that the domain doesn't exist.
+func transientDNSError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound && (dnsErr.IsTimeout || dnsErr.IsTemporary)
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// resolvConf is the configuration of /etc/resolv.conf exchangeMX queries,
+// read at the first lookup and again on SIGHUP. Nil when it can't be read.
+var (
+	resolvConf     atomic.Pointer[dns.ClientConfig]
+	resolvConfOnce sync.Once
+)
+
+// loadResolvConf reads /etc/resolv.conf into resolvConf.
+func loadResolvConf() {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		config = nil
+	}
+	resolvConf.Store(config)
+}
+
+// exchangeMX queries the nameservers of /etc/resolv.conf for the MX records
+// of domain in turn. ok is false when none of them gave an answer. NXDOMAIN
+// and empty answers are answers, reported with a not found error as the
+// system resolver does.
+func exchangeMX(ctx context.Context, domain string) (entry mxEntry, ok bool) {
+	resolvConfOnce.Do(loadResolvConf)
+	config := resolvConf.Load()
+	if config == nil || len(config.Servers) == 0 {
+		return mxEntry{}, false
+	}
+	client := &dns.Client{Timeout: time.Duration(config.Timeout) * time.Second}
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(domain), dns.TypeMX)
+
+	for _, server := range config.Servers {
+		server = net.JoinHostPort(server, config.Port)
+		reply, _, err := client.ExchangeContext(ctx, query, server)
+		if err != nil || reply.Truncated {
+			continue
+		}
+		switch reply.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+		default:
+			continue
+		}
+
+		entry = mxEntry{ttl: -1, resolvedAt: time.Now()}
+		for _, rr := range reply.Answer {
+			mx, isMX := rr.(*dns.MX)
+			if !isMX {
+				continue
+			}
+			entry.records = append(entry.records, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+			if ttl := time.Duration(mx.Hdr.Ttl) * time.Second; entry.ttl < 0 || ttl < entry.ttl {
+				entry.ttl = ttl
+			}
+		}
+		if len(entry.records) == 0 {
+			// Reported like the system resolver does
+			entry.err = &net.DNSError{Err: "no such host", Name: domain, Server: server, IsNotFound: true}
+		}
+		sort.SliceStable(entry.records, func(i, j int) bool {
+			return entry.records[i].Pref < entry.records[j].Pref
+		})
+		return entry, true
+	}
+	return mxEntry{}, false
+}
+
+func (r *mxResolver) cached(domain string) (mxEntry, bool) {
+	if r.ttl <= 0 {
+		return mxEntry{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[domain]
+	if !ok || time.Since(entry.resolvedAt) > r.ttl {
+		return mxEntry{}, false
+	}
+	return entry, true
+}
+
+// store caches answers, including domains that don't exist, but not
+// temporary failures.
+func (r *mxResolver) store(domain string, entry mxEntry) {
+	if r.ttl <= 0 {
+		return
+	}
+	var dnsErr *net.DNSError
+	if entry.err != nil && !(errors.As(entry.err, &dnsErr) && dnsErr.IsNotFound) {
+		return
+	}
+	r.mu.Lock()
+	r.cache[domain] = entry
+	r.mu.Unlock()
+}
+
+// sweep periodically drops expired answers.
+func (r *mxResolver) sweep() {
+	for range time.Tick(r.ttl) {
+		r.mu.Lock()
+		for domain, entry := range r.cache {
+			if time.Since(entry.resolvedAt) > r.ttl {
+				delete(r.cache, domain)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
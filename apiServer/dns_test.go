@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryMXStopsWithContext(t *testing.T) {
+	// A nameserver that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resolvConfOnce.Do(loadResolvConf)
+	defer resolvConf.Store(resolvConf.Load())
+	resolvConf.Store(&dns.ClientConfig{
+		Servers:  []string{"127.0.0.1"},
+		Port:     strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port),
+		Timeout:  5,
+		Attempts: 1,
+	})
+	defer func(count int, backoff time.Duration) { DNS_RETRY_COUNT, DNS_RETRY_BACKOFF = count, backoff }(DNS_RETRY_COUNT, DNS_RETRY_BACKOFF)
+	DNS_RETRY_COUNT, DNS_RETRY_BACKOFF = 3, time.Hour
+
+	// Four attempts of a server queried twice, and backoffs of 1h, 2h and 4h
+	if got, want := queryMXTimeout(), 4*2*5*time.Second+7*time.Hour; got != want {
+		t.Errorf("queryMXTimeout() = %s, want %s", got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if entry := queryMX(ctx, "example.com"); entry.err == nil {
+		t.Error("lookup through a silent nameserver succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookup gave up after %s, want the context's deadline", elapsed)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// DomainCatchAllResponse tells whether a domain accepts mail for any
+// address, in which case per-address SMTP checks can't tell mailboxes
+// apart.
+type DomainCatchAllResponse struct {
+	Domain   string `json:"domain"`
+	CatchAll bool   `json:"catch_all"`
+	HasMX    bool   `json:"has_mx"`
+	Cached   bool   `json:"cached"` // answered from an earlier probe
+}
+
+// CATCH_ALL_CACHE_TTL is how long GET /v1/domain/:domain/catchall answers
+// from its last probe of a domain, whether or not DOMAIN_REPUTATION_TTL is
+// set. Zero disables it.
+var CATCH_ALL_CACHE_TTL = time.Hour
+
+// catchAlls caches the answers of GET /v1/domain/:domain/catchall.
+var catchAlls = &catchAllCache{entries: map[string]catchAllEntry{}}
+
+type catchAllCache struct {
+	mu      sync.Mutex
+	entries map[string]catchAllEntry
+}
+
+type catchAllEntry struct {
+	catchAll  bool
+	checkedAt time.Time
+}
+
+func (e catchAllEntry) expired() bool {
+	return time.Since(e.checkedAt) > CATCH_ALL_CACHE_TTL
+}
+
+// get returns whether domain was found to be catch-all within
+// CATCH_ALL_CACHE_TTL, ok being false when it wasn't probed.
+func (c *catchAllCache) get(domain string) (catchAll, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[domain]
+	if !ok || entry.expired() {
+		return false, false
+	}
+	return entry.catchAll, true
+}
+
+func (c *catchAllCache) set(domain string, catchAll bool) {
+	if CATCH_ALL_CACHE_TTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[domain] = catchAllEntry{catchAll: catchAll, checkedAt: time.Now()}
+}
+
+// sweep periodically drops expired entries.
+func (c *catchAllCache) sweep() {
+	for range time.Tick(time.Hour) {
+		c.mu.Lock()
+		for domain, entry := range c.entries {
+			if entry.expired() {
+				delete(c.entries, domain)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// GetDomainCatchAll probes a domain with a random local part to determine
+// whether it is catch-all. Answers are cached for CATCH_ALL_CACHE_TTL, and
+// taken from the domain reputations when verifications already probed it.
+// A mail server that couldn't be probed is an error rather than a domain
+// that isn't catch-all.
+func GetDomainCatchAll(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	domain := strings.ToLower(strings.TrimSpace(ps.ByName("domain")))
+	if domain == "" {
+		respondWithError(w, r, http.StatusBadRequest, "domain is required")
+		return
+	}
+	resp := DomainCatchAllResponse{Domain: domain}
+
+	verifier := sharedVerifier()
+	// A domain without MX records is an answer, not a failed lookup
+	mx, _, err := checkMX(r.Context(), domain)
+	if err != nil && !isNotFound(err) {
+		respondWithError(w, r, verificationErrorStatus(err), err.Error())
+		return
+	}
+	resp.HasMX = err == nil && mx.HasMXRecord
+	if !resp.HasMX {
+		respondWithJSON(w, r, http.StatusOK, resp)
+		return
+	}
+	// Probed under the same REJECT_PRIVATE_MX rules as a verification
+	probe := *verifier.smtp
+	if internalDomain(domain) {
+		probe.publicOnly = false
+	} else if REJECT_PRIVATE_MX {
+		if err := checkMXRoutable(r.Context(), mx.Records); err != nil {
+			respondWithError(w, r, verificationErrorStatus(err), err.Error())
+			return
+		}
+	}
+
+	if catchAll, known := catchAlls.get(domain); known {
+		resp.CatchAll, resp.Cached = catchAll, true
+		respondWithJSON(w, r, http.StatusOK, resp)
+		return
+	}
+	if catchAll, known := domains.catchAll(domain); known {
+		resp.CatchAll, resp.Cached = catchAll, true
+		respondWithJSON(w, r, http.StatusOK, resp)
+		return
+	}
+	if REQUIRE_PROXY && len(verifier.smtp.proxies.proxies) == 0 {
+		respondWithError(w, r, http.StatusServiceUnavailable, noteSkippedNoProxy)
+		return
+	}
+
+	smtp, _, err := probeThroughBreaker(r.Context(), &probe, domain, "")
+	if errors.Is(err, errSMTPUnavailable) {
+		respondWithError(w, r, http.StatusServiceUnavailable, noteSMTPUnavailable)
+		return
+	}
+	domains.record(domain, smtp, err)
+	if err != nil {
+		respondWithError(w, r, verificationErrorStatus(err), err.Error())
+		return
+	}
+	if !smtp.HostExists {
+		respondWithError(w, r, http.StatusBadGateway, "Mail server of "+domain+" could not be probed")
+		return
+	}
+	resp.CatchAll = smtp.CatchAll
+	catchAlls.set(domain, resp.CatchAll)
+	respondWithJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// stubMX answers the MX lookups of domain with entry for the rest of the
+// test.
+func stubMX(t *testing.T, domain string, entry mxEntry) {
+	t.Helper()
+	oldResolver := resolver
+	t.Cleanup(func() { resolver = oldResolver })
+	resolver = newMXResolver(0, time.Minute)
+	entry.ttl, entry.resolvedAt = -1, time.Now()
+	resolver.cache[domain] = entry
+}
+
+// getCatchAll sends GET /v1/domain/:domain/catchall to GetDomainCatchAll.
+func getCatchAll(domain string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/v1/domain/"+domain+"/catchall", nil)
+	GetDomainCatchAll(w, r, httprouter.Params{{Key: "domain", Value: domain}})
+	return w
+}
+
+func TestDomainCatchAllWithoutMX(t *testing.T) {
+	stubVerifier(t, deliverableVerification)
+	stubMX(t, "nomx.example", mxEntry{err: &net.DNSError{Err: "no such host", Name: "nomx.example", IsNotFound: true}})
+
+	w := getCatchAll("nomx.example")
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp DomainCatchAllResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.HasMX || resp.CatchAll || resp.Domain != "nomx.example" {
+		t.Errorf("response = %+v, want has_mx false", resp)
+	}
+}
+
+func TestDomainCatchAllRejectsPrivateMX(t *testing.T) {
+	stubVerifier(t, deliverableVerification)
+	// Without publicOnly, as behind a proxy, only the MX check stops the probe
+	verifier := &Verifier{smtp: &smtpProbe{heloNames: []string{"example.com"}, proxies: newProxyPool(nil, 0), connectTimeout: time.Second, operationTimeout: time.Second}}
+	sharedVerifier = func() *Verifier { return verifier }
+	stubMX(t, "loopback.example", mxEntry{records: []*net.MX{{Host: "127.0.0.1", Pref: 10}}})
+
+	w := getCatchAll("loopback.example")
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), ErrMXNotRoutable) {
+		t.Errorf("answered %d %s, want 422 %s", w.Code, w.Body, ErrMXNotRoutable)
+	}
+}
+
+func TestDomainCatchAllCached(t *testing.T) {
+	stubVerifier(t, deliverableVerification)
+	// No proxy and no mail server, answered from the cache or not at all
+	verifier := &Verifier{smtp: &smtpProbe{proxies: newProxyPool(nil, 0)}}
+	sharedVerifier = func() *Verifier { return verifier }
+	stubMX(t, "cached.example", mxEntry{records: []*net.MX{{Host: "192.0.2.1", Pref: 10}}})
+	defer func(old *catchAllCache) { catchAlls = old }(catchAlls)
+	catchAlls = &catchAllCache{entries: map[string]catchAllEntry{}}
+	catchAlls.set("cached.example", true)
+
+	w := getCatchAll("cached.example")
+	var resp DomainCatchAllResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("answered %d %s, want 200", w.Code, w.Body)
+	}
+	if !resp.CatchAll || !resp.Cached || !resp.HasMX {
+		t.Errorf("response = %+v, want the cached catch-all answer", resp)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	// RDAP_URL is the RDAP service queried for registration dates with
+	// ?domain_age=true, the registrable domain being appended to it. The
+	// default redirects to the registry of each TLD.
+	RDAP_URL = "https://rdap.org/domain/"
+	// DOMAIN_AGE_CACHE_TTL is how long registration dates are cached.
+	// They only change when a domain is re-registered.
+	DOMAIN_AGE_CACHE_TTL = 7 * 24 * time.Hour
+	// YOUNG_DOMAIN_DAYS is the age in days under which a domain is
+	// reported as young_domain.
+	YOUNG_DOMAIN_DAYS = 30
+)
+
+// domainAgeFailureTTL is how long a failed lookup is remembered, so domains
+// whose registry doesn't answer aren't queried for every address.
+const domainAgeFailureTTL = 10 * time.Minute
+
+// domainAges looks up the registration dates of domains for all requests.
+var domainAges = &domainAgeChecker{cache: map[string]domainAgeEntry{}}
+
+// domainAgeChecker caches registration dates by registrable domain and
+// backs off while the RDAP service rate limits it.
+type domainAgeChecker struct {
+	group singleflight.Group
+
+	mu               sync.Mutex
+	cache            map[string]domainAgeEntry
+	rateLimitedUntil time.Time
+}
+
+type domainAgeEntry struct {
+	registered time.Time // zero when the lookup failed
+	checkedAt  time.Time
+}
+
+// registered returns when the registrable domain of the ASCII domain was
+// registered. ok is false when the date couldn't be found or ctx ended
+// first, in which case the age is left out of the response. A lookup given
+// up on still completes and is cached for the next callers.
+func (c *domainAgeChecker) registered(ctx context.Context, domain string) (registered time.Time, ok bool) {
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	c.mu.Lock()
+	entry, cached := c.cache[registrable]
+	limited := time.Now().Before(c.rateLimitedUntil)
+	c.mu.Unlock()
+	if cached && !entry.expired() {
+		return entry.registered, !entry.registered.IsZero()
+	}
+	if limited {
+		return time.Time{}, false
+	}
+
+	results := c.group.DoChan(registrable, func() (interface{}, error) {
+		registered, err := c.lookup(registrable)
+		if err != nil {
+			debugf(context.Background(), "%s: RDAP lookup failed: %v", registrable, err)
+		}
+		c.mu.Lock()
+		c.cache[registrable] = domainAgeEntry{registered: registered, checkedAt: time.Now()}
+		c.mu.Unlock()
+		return registered, nil
+	})
+	select {
+	case res := <-results:
+		registered = res.Val.(time.Time)
+		return registered, !registered.IsZero()
+	case <-ctx.Done():
+		return time.Time{}, false
+	}
+}
+
+func (e domainAgeEntry) expired() bool {
+	ttl := DOMAIN_AGE_CACHE_TTL
+	if e.registered.IsZero() {
+		ttl = domainAgeFailureTTL
+	}
+	return time.Since(e.checkedAt) > ttl
+}
+
+// lookup queries RDAP_URL for the registration event of domain.
+func (c *domainAgeChecker) lookup(domain string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, RDAP_URL+domain, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := time.Minute
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		c.mu.Lock()
+		c.rateLimitedUntil = time.Now().Add(wait)
+		c.mu.Unlock()
+		return time.Time{}, fmt.Errorf("rate limited for %s", wait)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("RDAP answered %s", resp.Status)
+	}
+
+	var body struct {
+		Events []struct {
+			Action string    `json:"eventAction"`
+			Date   time.Time `json:"eventDate"`
+		} `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return time.Time{}, err
+	}
+	for _, event := range body.Events {
+		if event.Action == "registration" {
+			return event.Date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no registration event")
+}
+
+// sweep periodically drops expired entries.
+func (c *domainAgeChecker) sweep() {
+	for range time.Tick(time.Hour) {
+		c.mu.Lock()
+		for domain, entry := range c.cache {
+			if entry.expired() {
+				delete(c.cache, domain)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// RESPONSE_ENVELOPE wraps JSON responses, successful or not, in a
+// ResponseEnvelope for gateways that expect a uniform shape. Off by
+// default, keeping the flat bodies. JSON-RPC, streamed and downloaded
+// responses are never wrapped, since their shape is fixed by their format.
+var RESPONSE_ENVELOPE bool
+
+// ResponseEnvelope is the body of every JSON response with
+// RESPONSE_ENVELOPE. Error is null on success. For failures Data holds the
+// details the flat error body carries next to "error", if any.
+type ResponseEnvelope struct {
+	Data  interface{}  `json:"data"`
+	Error *string      `json:"error"`
+	Meta  EnvelopeMeta `json:"meta"`
+}
+
+// EnvelopeMeta describes the request a ResponseEnvelope answers.
+type EnvelopeMeta struct {
+	RequestID  string `json:"request_id"`
+	DurationMS int64  `json:"duration_ms"` // time spent handling the request
+	// CacheHits is how many emails of a bulk verification were answered
+	// from the cache, see withCacheHits
+	CacheHits *int `json:"cache_hits,omitempty"`
+}
+
+// newEnvelope wraps data, and errMsg unless it is empty, for the response
+// to r.
+func newEnvelope(r *http.Request, data interface{}, errMsg string) ResponseEnvelope {
+	meta := requestMetaFrom(r.Context())
+	env := ResponseEnvelope{
+		Data: data,
+		Meta: EnvelopeMeta{
+			RequestID:  meta.id,
+			DurationMS: time.Since(meta.start).Milliseconds(),
+		},
+	}
+	if hits, ok := r.Context().Value(cacheHitsKey{}).(int); ok {
+		env.Meta.CacheHits = &hits
+	}
+	if errMsg != "" {
+		env.Error = &errMsg
+	}
+	return env
+}
+
+type cacheHitsKey struct{}
+
+// withCacheHits records the cache hits of a bulk verification for the meta
+// of its response.
+func withCacheHits(r *http.Request, hits int) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), cacheHitsKey{}, hits))
+}
+
+// requestMeta identifies a request and when it started.
+type requestMeta struct {
+	id    string
+	start time.Time
+}
+
+type requestMetaKey struct{}
+
+// requestMetaFrom returns the metadata withRequestMeta attached to ctx.
+func requestMetaFrom(ctx context.Context) requestMeta {
+	if meta, ok := ctx.Value(requestMetaKey{}).(requestMeta); ok {
+		return meta
+	}
+	return requestMeta{start: time.Now()}
+}
+
+// withRequestMeta records when each request started and gives it an ID,
+// reusing the caller's X-Request-ID when it looks like one. The ID is
+// echoed in the X-Request-ID response header.
+func withRequestMeta(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		meta := requestMeta{id: r.Header.Get("X-Request-ID"), start: time.Now()}
+		if !validRequestID(meta.id) {
+			id := make([]byte, 16)
+			rand.Read(id)
+			meta.id = hex.EncodeToString(id)
+		}
+		w.Header().Set("X-Request-ID", meta.id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestMetaKey{}, meta)))
+	})
+}
+
+// validRequestID reports whether a caller's request ID is safe to echo and
+// log: up to 128 printable ASCII characters without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+var (
+	// GRAVATAR_CONCURRENCY caps the gravatar.com lookups in flight, apart
+	// from the SMTP checks so neither can starve the other.
+	GRAVATAR_CONCURRENCY = 4
+	GRAVATAR_CACHE_TTL   = 24 * time.Hour
+	// GRAVATAR_URL is where avatars are looked up, the email hash being
+	// appended to it.
+	GRAVATAR_URL = "https://www.gravatar.com/avatar/"
+)
+
+// gravatars performs the gravatar checks of all requests.
+var gravatars = newGravatarChecker(GRAVATAR_CONCURRENCY, GRAVATAR_CACHE_TTL)
+
+// gravatarChecker bounds the concurrency of gravatar lookups and caches
+// their results by email hash, the same key gravatar.com uses.
+type gravatarChecker struct {
+	slots chan struct{}
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]gravatarEntry
+}
+
+type gravatarEntry struct {
+	gravatar  *emailVerifier.Gravatar
+	checkedAt time.Time
+}
+
+func newGravatarChecker(concurrency int, ttl time.Duration) *gravatarChecker {
+	return &gravatarChecker{
+		slots: make(chan struct{}, max(concurrency, 1)),
+		ttl:   ttl,
+		cache: map[string]gravatarEntry{},
+	}
+}
+
+// check returns the gravatar of email, from the cache when possible, or the
+// error of ctx when it ends first.
+func (g *gravatarChecker) check(ctx context.Context, email string) (*emailVerifier.Gravatar, error) {
+	hash := gravatarHash(email)
+	if gravatar, ok := g.cached(hash); ok {
+		return gravatar, nil
+	}
+
+	select {
+	case g.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-g.slots }()
+
+	gravatar, err := lookupGravatar(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if g.ttl > 0 {
+		g.mu.Lock()
+		g.cache[hash] = gravatarEntry{gravatar: gravatar, checkedAt: time.Now()}
+		g.mu.Unlock()
+	}
+	return gravatar, nil
+}
+
+// lookupGravatar asks GRAVATAR_URL for the avatar of hash. Unlike the
+// library's CheckGravatar it goes through httpClient, reusing connections
+// between lookups.
+func lookupGravatar(ctx context.Context, hash string) (*emailVerifier.Gravatar, error) {
+	avatarURL := GRAVATAR_URL + hash + "?d=404"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, avatarURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Read to the end so the connection can be reused
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return &emailVerifier.Gravatar{HasGravatar: true, GravatarUrl: avatarURL}, nil
+	case http.StatusNotFound:
+		// d=404 answers 404 instead of the default image
+		return &emailVerifier.Gravatar{}, nil
+	default:
+		return nil, fmt.Errorf("gravatar answered %s", resp.Status)
+	}
+}
+
+func (g *gravatarChecker) cached(hash string) (*emailVerifier.Gravatar, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	entry, ok := g.cache[hash]
+	if !ok || time.Since(entry.checkedAt) > g.ttl {
+		return nil, false
+	}
+	return entry.gravatar, true
+}
+
+// sweep periodically drops expired entries.
+func (g *gravatarChecker) sweep() {
+	for range time.Tick(time.Minute) {
+		g.mu.Lock()
+		for hash, entry := range g.cache {
+			if time.Since(entry.checkedAt) > g.ttl {
+				delete(g.cache, hash)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// gravatarHash hashes email the way gravatar.com identifies avatars.
+func gravatarHash(email string) string {
+	sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
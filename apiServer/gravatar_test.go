@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gravatarServer serves GRAVATAR_URL for the rest of the test, with a fresh
+// httpClient. It counts the connections made to it.
+func gravatarServer(t *testing.T, handler http.HandlerFunc) *atomic.Int32 {
+	t.Helper()
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+
+	oldURL, oldClient := GRAVATAR_URL, httpClient
+	t.Cleanup(func() {
+		srv.Close()
+		GRAVATAR_URL, httpClient = oldURL, oldClient
+	})
+	GRAVATAR_URL = srv.URL + "/avatar/"
+	httpClient = newHTTPClient()
+	return &conns
+}
+
+func TestLookupGravatar(t *testing.T) {
+	known := gravatarHash("known@example.com")
+	conns := gravatarServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("d") != "404" {
+			t.Errorf("request %s doesn't ask for a 404 instead of the default image", r.URL)
+		}
+		if r.URL.Path != "/avatar/"+known {
+			http.NotFound(w, r)
+		}
+	})
+
+	for _, email := range []string{"known@example.com", "unknown@example.com", "Known@Example.com"} {
+		gravatar, err := lookupGravatar(context.Background(), gravatarHash(email))
+		if err != nil {
+			t.Fatalf("%s: %v", email, err)
+		}
+		if want := email != "unknown@example.com"; gravatar.HasGravatar != want {
+			t.Errorf("%s: HasGravatar = %t, want %t", email, gravatar.HasGravatar, want)
+		}
+	}
+	// Every lookup went through the pooled httpClient
+	if got := conns.Load(); got != 1 {
+		t.Errorf("lookups opened %d connections, want them to reuse one", got)
+	}
+}
+
+func TestLookupGravatarTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { HTTP_TIMEOUT = timeout }(HTTP_TIMEOUT)
+	HTTP_TIMEOUT = 50 * time.Millisecond
+	gravatarServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	start := time.Now()
+	if _, err := lookupGravatar(context.Background(), gravatarHash("slow@example.com")); err == nil {
+		t.Fatal("lookup of a server slower than HTTP_TIMEOUT succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookup gave up after %s, want HTTP_TIMEOUT", elapsed)
+	}
+
+	// A shorter context stops the lookup as well
+	HTTP_TIMEOUT = 5 * time.Second
+	httpClient = newHTTPClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := gravatars.check(ctx, "slow@example.com"); err == nil {
+		t.Fatal("lookup outlasting its context succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookup gave up after %s, want the context's deadline", elapsed)
+	}
+}
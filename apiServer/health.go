@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// version identifies the build, set with -ldflags "-X main.version=...".
+var version = "dev"
+
+// GetHealth reports that the server is up. It needs no token, so load
+// balancers can probe it, and keeps answering in maintenance mode.
+func GetHealth(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	respondWithJSON(w, r, http.StatusOK, map[string]interface{}{
+		"status":      "ok",
+		"maintenance": runtimeSettings().MaintenanceMode,
+	})
+}
+
+// GetVersion returns the version of the running build
+func GetVersion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"version": version})
+}
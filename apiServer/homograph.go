@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// HOMOGRAPH_CHECK reports homograph_suspect for every valid address, set
+// when the domain looks crafted to pass for another one: a label mixing
+// scripts, as in "pаypal" with a Cyrillic "а", or written entirely with
+// Cyrillic or Greek letters that look Latin, as in "аррӏе". golang.org/x/text
+// has no confusables data, so the lookalikes are the common ones listed in
+// latinLookalikes rather than the full Unicode set.
+var HOMOGRAPH_CHECK bool
+
+// homographScripts are the scripts told apart when looking for mixed-script
+// labels. Letters of other scripts are ignored.
+var homographScripts = map[string]*unicode.RangeTable{
+	"Latin":    unicode.Latin,
+	"Cyrillic": unicode.Cyrillic,
+	"Greek":    unicode.Greek,
+	"Armenian": unicode.Armenian,
+	"Hebrew":   unicode.Hebrew,
+	"Arabic":   unicode.Arabic,
+	"Han":      unicode.Han,
+	"Hiragana": unicode.Hiragana,
+	"Katakana": unicode.Katakana,
+	"Hangul":   unicode.Hangul,
+}
+
+// latinLookalikes are Cyrillic and Greek letters rendered like Latin ones
+// in most fonts.
+const latinLookalikes = "аеіјорсухһӏԁԛԝѕѵАВЕКМНОРСТХЅІЈԚԜ" +
+	"αεικνορτυχΑΒΕΖΗΙΚΜΝΟΡΤΥΧ"
+
+// homographSuspect reports whether a label of the Unicode domain mixes
+// scripts, or is written only with letters that look Latin without being
+// Latin.
+func homographSuspect(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		scripts := map[string]bool{}
+		lookalikesOnly := true
+		for _, r := range label {
+			if !unicode.IsLetter(r) {
+				continue
+			}
+			for name, table := range homographScripts {
+				if unicode.Is(table, r) {
+					scripts[name] = true
+				}
+			}
+			if !strings.ContainsRune(latinLookalikes, r) {
+				lookalikesOnly = false
+			}
+		}
+		if len(scripts) > 1 && !cjkScripts(scripts) {
+			return true
+		}
+		if (scripts["Cyrillic"] || scripts["Greek"]) && lookalikesOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// cjkScripts reports whether scripts is one of the combinations normally
+// written together: Japanese mixes Han with the kana, Korean Han with
+// Hangul, and both may include Latin.
+func cjkScripts(scripts map[string]bool) bool {
+	if !scripts["Han"] && !scripts["Hiragana"] && !scripts["Katakana"] && !scripts["Hangul"] {
+		return false
+	}
+	for name := range scripts {
+		switch name {
+		case "Latin", "Han", "Hiragana", "Katakana", "Hangul":
+		default:
+			return false
+		}
+	}
+	return !(scripts["Hangul"] && (scripts["Hiragana"] || scripts["Katakana"]))
+}
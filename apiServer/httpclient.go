@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+var (
+	// HTTP_TIMEOUT bounds each outbound HTTP request, to gravatar.com,
+	// RDAP_URL or ABUSE_WEBHOOK_URL.
+	HTTP_TIMEOUT = 10 * time.Second
+	// HTTP_MAX_IDLE_CONNS_PER_HOST is how many idle connections are kept
+	// open per host for reuse. Go's default of 2 makes concurrent gravatar
+	// lookups open, and pay the TLS handshake of, a new connection nearly
+	// every time.
+	HTTP_MAX_IDLE_CONNS_PER_HOST = 16
+	// HTTP_IDLE_CONN_TIMEOUT is how long an idle connection is kept open.
+	HTTP_IDLE_CONN_TIMEOUT = 90 * time.Second
+)
+
+// httpClient makes every outbound HTTP request, so they share its pool of
+// connections.
+var httpClient = newHTTPClient()
+
+// newHTTPClient creates a client configured from the HTTP_ settings.
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = HTTP_MAX_IDLE_CONNS_PER_HOST
+	transport.MaxIdleConns = max(transport.MaxIdleConns, HTTP_MAX_IDLE_CONNS_PER_HOST)
+	transport.IdleConnTimeout = HTTP_IDLE_CONN_TIMEOUT
+	return &http.Client{Timeout: HTTP_TIMEOUT, Transport: transport}
+}
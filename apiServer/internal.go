@@ -0,0 +1,22 @@
+package main
+
+import "strings"
+
+// INTERNAL_DOMAINS lists domains only reachable on an internal network,
+// such as corp.internal, whose addresses are verified without CHECK_TLD and
+// REJECT_PRIVATE_MX, for staging environments testing against internal
+// mail servers. Each entry covers the domain and its subdomains, a leading
+// "*." being accepted, as in *.internal. The other checks still apply.
+var INTERNAL_DOMAINS []string
+
+// internalDomain reports whether domain is covered by INTERNAL_DOMAINS.
+func internalDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, entry := range INTERNAL_DOMAINS {
+		entry = strings.ToLower(strings.TrimPrefix(entry, "*."))
+		if domain == entry || strings.HasSuffix(domain, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
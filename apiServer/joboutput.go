@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// JOB_OUTPUT_DIR is the directory jobs may write their results to with
+// "output_path", for pipelines running on the same host. Writing files is
+// disabled while it is empty.
+var JOB_OUTPUT_DIR string
+
+// resolveOutputPath validates the output_path of a job and returns the path
+// its results will be written to. The path must be relative to
+// JOB_OUTPUT_DIR, stay inside it even through symlinks, end in .json or
+// .csv, and not exist yet. Its directory must already exist.
+func resolveOutputPath(path string) (string, error) {
+	if JOB_OUTPUT_DIR == "" {
+		return "", errors.New("output_path is only accepted when JOB_OUTPUT_DIR is set")
+	}
+	if !filepath.IsLocal(path) {
+		return "", errors.New("output_path must be a relative path inside JOB_OUTPUT_DIR")
+	}
+	if ext := filepath.Ext(path); ext != ".json" && ext != ".csv" {
+		return "", errors.New("output_path must end in .json or .csv")
+	}
+
+	root, err := filepath.EvalSymlinks(JOB_OUTPUT_DIR)
+	if err != nil {
+		return "", fmt.Errorf("JOB_OUTPUT_DIR is not accessible: %w", err)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(root, filepath.Dir(path)))
+	if err != nil {
+		return "", errors.New("the directory of output_path doesn't exist")
+	}
+	if rel, err := filepath.Rel(root, dir); err != nil || !filepath.IsLocal(rel) {
+		return "", errors.New("output_path must be a relative path inside JOB_OUTPUT_DIR")
+	}
+
+	full := filepath.Join(dir, filepath.Base(path))
+	if _, err := os.Lstat(full); err == nil {
+		return "", fmt.Errorf("output_path %s already exists", path)
+	}
+	return full, nil
+}
+
+// writeResultsFile writes results to path, as CSV when it ends in .csv and
+// as the JSON served by the job endpoints otherwise. Existing files are
+// never overwritten.
+func writeResultsFile(path string, results []BulkVerificationResult, body []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(path, ".csv") {
+		err = writeResultsCSV(f, results)
+	} else {
+		_, err = f.Write(body)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// resultsCSVHeader names the columns written by writeResultsCSV.
+var resultsCSVHeader = []string{
+	"email", "error", "syntax_valid", "reachable", "deliverable", "confidence",
+	"disposable", "role_account", "free", "has_mx_records", "catch_all",
+}
+
+// writeResultsCSV writes one row per result, with the main verdicts of its
+// verification. Rows for failed verifications only carry the error.
+func writeResultsCSV(f io.Writer, results []BulkVerificationResult) error {
+	w := csv.NewWriter(f)
+	if err := w.Write(resultsCSVHeader); err != nil {
+		return err
+	}
+	for _, res := range results {
+		row := make([]string, len(resultsCSVHeader))
+		row[0], row[1] = res.Email, res.Error
+		if v := res.Result; v != nil && v.Result != nil {
+			catchAll := v.SMTP != nil && v.SMTP.CatchAll
+			copy(row[2:], []string{
+				strconv.FormatBool(v.Syntax.Valid),
+				v.Reachable,
+				strconv.FormatBool(v.Deliverable),
+				strconv.FormatFloat(v.Confidence, 'f', -1, 64),
+				strconv.FormatBool(v.Disposable),
+				strconv.FormatBool(v.RoleAccount),
+				strconv.FormatBool(v.Free),
+				strconv.FormatBool(v.HasMxRecords),
+				strconv.FormatBool(catchAll),
+			})
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	JOB_INLINE_MAX_BYTES = 1 << 20 // larger results are only served by the download endpoint
+	JOB_TTL              = 24 * time.Hour
+)
+
+const (
+	jobRunning   = "running"
+	jobCompleted = "completed"
+)
+
+// jobs holds the background bulk verification jobs.
+var jobs = &jobStore{jobs: map[string]*job{}}
+
+// job is a bulk verification running in the background.
+type job struct {
+	mu          sync.Mutex
+	id          string
+	status      string
+	total       int
+	completed   int
+	createdAt   time.Time
+	completedAt time.Time
+	results     []byte // JSON results, set once the job is completed
+	outputPath  string // file the results are written to, see JOB_OUTPUT_DIR
+	outputError string // why writing outputPath failed
+	token       string // id of the token that started it, the only one it is shown to
+}
+
+// JobResponse is the status of a job as returned to clients. Results are
+// inlined when they are small enough, otherwise DownloadURL points to them.
+type JobResponse struct {
+	ID          string          `json:"id"`
+	Status      string          `json:"status"`
+	Total       int             `json:"total"`
+	Completed   int             `json:"completed"`
+	CreatedAt   string          `json:"created_at"`
+	CompletedAt string          `json:"completed_at,omitempty"`
+	Results     json.RawMessage `json:"results,omitempty"`
+	DownloadURL string          `json:"download_url,omitempty"`
+	OutputPath  string          `json:"output_path,omitempty"`  // where the results are written
+	OutputError string          `json:"output_error,omitempty"` // set if writing them failed
+}
+
+func (j *job) response() JobResponse {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	resp := JobResponse{
+		ID:        j.id,
+		Status:    j.status,
+		Total:     j.total,
+		Completed: j.completed,
+		CreatedAt: j.createdAt.UTC().Format(time.RFC3339),
+
+		OutputPath:  j.outputPath,
+		OutputError: j.outputError,
+	}
+	if j.status == jobCompleted {
+		resp.CompletedAt = j.completedAt.UTC().Format(time.RFC3339)
+		if len(j.results) <= JOB_INLINE_MAX_BYTES {
+			resp.Results = j.results
+		} else {
+			resp.DownloadURL = "/v1/jobs/" + j.id + "/download"
+		}
+	}
+	return resp
+}
+
+// run verifies emails and stores the results on the job, writing them to
+// its outputPath too when set. A job verifies as many emails at once as a
+// bulk request may contain.
+func (j *job) run(ctx context.Context, emails []string, opts bulkOptions) {
+	outcome := verifyAll(ctx, sharedVerifier(), emails, runtimeSettings().MaxEmails, opts, func() {
+		j.mu.Lock()
+		j.completed++
+		j.mu.Unlock()
+	})
+	body, err := json.Marshal(outcome.results)
+	if err != nil {
+		body, _ = json.Marshal(map[string]string{"error": "Failed to format results"})
+	}
+
+	var outputError string
+	if j.outputPath != "" {
+		if err := writeResultsFile(j.outputPath, outcome.results, body); err != nil {
+			log.Printf("Job %s: writing results to %s failed: %v", j.id, j.outputPath, err)
+			outputError = "Failed to write results file"
+		}
+	}
+
+	j.mu.Lock()
+	j.outputError = outputError
+	j.status = jobCompleted
+	j.completedAt = time.Now()
+	j.results = body
+	j.mu.Unlock()
+}
+
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// create registers a new running job for total emails, started by the
+// token with the given id.
+func (s *jobStore) create(total int, token string) *job {
+	id := make([]byte, 16)
+	rand.Read(id)
+	j := &job{
+		id:        hex.EncodeToString(id),
+		status:    jobRunning,
+		total:     total,
+		createdAt: time.Now(),
+		token:     token,
+	}
+
+	s.mu.Lock()
+	s.jobs[j.id] = j
+	s.mu.Unlock()
+	return j
+}
+
+// get returns the job with the given id when the token with the id token
+// started it. Other tokens are told it doesn't exist.
+func (s *jobStore) get(id, token string) (*job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.token != token {
+		return nil, false
+	}
+	return j, true
+}
+
+// sweep periodically forgets jobs completed more than JOB_TTL ago.
+func (s *jobStore) sweep() {
+	for range time.Tick(time.Minute) {
+		s.mu.Lock()
+		for id, j := range s.jobs {
+			j.mu.Lock()
+			expired := j.status == jobCompleted && time.Since(j.completedAt) > JOB_TTL
+			j.mu.Unlock()
+			if expired {
+				delete(s.jobs, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// CreateJob starts a background verification of the emails in the body,
+// accepting the same shapes as the bulk endpoint
+func CreateJob(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req, err := decodeBulkRequest(r.Body)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Emails) == 0 {
+		respondWithError(w, r, http.StatusBadRequest, "No emails provided")
+		return
+	}
+	if maxEmails := tokenConfigFrom(r.Context()).jobMaxEmails(); len(req.Emails) > maxEmails {
+		respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("Too many emails provided (max %d)", maxEmails))
+		return
+	}
+
+	opts, err := req.bulkOptions(r)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if invalid := invalidBulkEmails(req.Emails); len(invalid) > 0 && !opts.lenient {
+		respondWithInvalidEmails(w, r, invalid)
+		return
+	}
+	if opts.failFast {
+		respondWithError(w, r, http.StatusBadRequest, "fail_fast is only accepted by the bulk endpoints")
+		return
+	}
+
+	var outputPath string
+	if req.OutputPath != "" {
+		if outputPath, err = resolveOutputPath(req.OutputPath); err != nil {
+			respondWithError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	j := startJob(r, req.Emails, opts, outputPath)
+	w.Header().Set("Location", "/v1/jobs/"+j.id)
+	respondWithJSON(w, r, http.StatusAccepted, j.response())
+}
+
+// startJob starts a job verifying emails for the request r, writing its
+// results to outputPath unless it is empty.
+func startJob(r *http.Request, emails []string, opts bulkOptions, outputPath string) *job {
+	opts.maxQueueWait = 0 // jobs run in the background and can wait
+	opts.pool = jobSlots
+	j := jobs.create(len(emails), tokenConfigFrom(r.Context()).id)
+	j.outputPath = outputPath
+	// The job outlives the request, but keeps its token
+	go j.run(context.WithoutCancel(r.Context()), emails, opts)
+	return j
+}
+
+// GetJob returns the status of a job started with the request's token,
+// with its results once completed
+func GetJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	j, ok := jobs.get(ps.ByName("id"), tokenConfigFrom(r.Context()).id)
+	if !ok {
+		respondWithError(w, r, http.StatusNotFound, "Job not found")
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, j.response())
+}
+
+// DownloadJobResults streams the results of a completed job started with
+// the request's token as a file
+func DownloadJobResults(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	j, ok := jobs.get(ps.ByName("id"), tokenConfigFrom(r.Context()).id)
+	if !ok {
+		respondWithError(w, r, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	j.mu.Lock()
+	results := j.results
+	j.mu.Unlock()
+	if results == nil {
+		respondWithError(w, r, http.StatusConflict, "Job is not completed yet")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="job-%s.json"`, j.id))
+	w.Header().Set("Content-Length", fmt.Sprint(len(results)))
+	// Written in chunks, each with its own deadline, so a slow client gets
+	// the whole of a large job rather than what fits in WriteTimeout
+	rc := http.NewResponseController(w)
+	for len(results) > 0 {
+		rc.SetWriteDeadline(time.Now().Add(streamIdleTimeout))
+		n := min(len(results), downloadChunkSize)
+		if _, err := w.Write(results[:n]); err != nil {
+			return
+		}
+		results = results[n:]
+	}
+}
+
+// downloadChunkSize is how much of a job's results DownloadJobResults
+// writes per deadline.
+const downloadChunkSize = 256 << 10
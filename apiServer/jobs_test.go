@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestDownloadJobResults(t *testing.T) {
+	j := jobs.create(1, "")
+	results := bytes.Repeat([]byte("x"), 3*downloadChunkSize+1)
+	j.mu.Lock()
+	j.status, j.results = jobCompleted, results
+	j.mu.Unlock()
+
+	router := httprouter.New()
+	router.GET("/v1/jobs/:id/download", DownloadJobResults)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/v1/jobs/" + j.id + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, results) {
+		t.Errorf("answered %d with %d bytes, want the %d bytes of results", resp.StatusCode, len(body), len(results))
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="job-`+j.id+`.json"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+}
+
+func TestJobsOnlyShownToTheirToken(t *testing.T) {
+	j := jobs.create(1, "owner")
+	j.mu.Lock()
+	j.status, j.results = jobCompleted, []byte("[]")
+	j.mu.Unlock()
+
+	for token, status := range map[string]int{"owner": http.StatusOK, "other": http.StatusNotFound, "": http.StatusNotFound} {
+		ctx := context.WithValue(context.Background(), tokenConfigKey{}, &tokenConfig{id: token})
+		params := httprouter.Params{{Key: "id", Value: j.id}}
+		for name, handler := range map[string]httprouter.Handle{"GetJob": GetJob, "DownloadJobResults": DownloadJobResults} {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, "/v1/jobs/"+j.id, nil).WithContext(ctx), params)
+			if w.Code != status {
+				t.Errorf("%s for token %q answered %d, want %d", name, token, w.Code, status)
+			}
+		}
+	}
+}
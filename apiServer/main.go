@@ -1,162 +1,388 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/julienschmidt/httprouter"
-
-	emailVerifier "github.com/AfterShip/email-verifier"
 )
 
-var MAX_EMAILS = 15
-
 func verifyToken(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		log.Println("verifyToken middleware executed")
-
 		authToken := r.Header.Get("Authorization")
-		log.Println("Authorization header received:", authToken)
-
 		expectedToken := os.Getenv("AUTH_TOKEN")
-		log.Println("Expected token from environment:", expectedToken)
 
 		if authToken == "" {
 			log.Println("Missing Authorization header")
-			http.Error(w, "Authorization token is required", http.StatusUnauthorized)
+			respondWithTextError(w, r, http.StatusUnauthorized, "Authorization token is required")
 			return
 		}
 
-		if authToken != expectedToken {
-			log.Println("Invalid Authorization token")
-			http.Error(w, "Invalid authorization token", http.StatusForbidden)
+		config, ok := tokens[authToken]
+		if authToken != expectedToken && !ok {
+			// Only fingerprints are logged, like in abuse alerts
+			log.Printf("Invalid Authorization token %s", tokenFingerprint(authToken))
+			respondWithTextError(w, r, http.StatusForbidden, "Invalid authorization token")
+			return
+		}
+		if config == nil {
+			config = defaultTokenConfig
+		}
+		if !config.allow() {
+			log.Printf("Rate limit exceeded for token %s", config.id)
+			w.Header().Set("Retry-After", "60")
+			respondWithTextError(w, r, http.StatusTooManyRequests, "Rate limit exceeded")
 			return
 		}
 
-		log.Println("Authorization successful")
-		next(w, r, ps)
+		next(w, r.WithContext(withTokenConfig(r.Context(), config)), ps)
 	}
 }
 
 // GetEmailVerification handles email verification requests
 func GetEmailVerification(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	fromEmail := os.Getenv("FROM_EMAIL")
-	heloName := os.Getenv("HELO_NAME")
-	proxyURL := os.Getenv("PROXY_URL")
-
-	if fromEmail == "" || heloName == "" {
-		http.Error(w, "FROM_EMAIL and HELO_NAME must be set in environment variables", http.StatusInternalServerError)
+	input := emailParam(ps)
+	if input == "" {
+		respondWithError(w, r, http.StatusBadRequest, "email is required")
+		return
+	}
+	email, err := addressFromInput(input)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if os.Getenv("FROM_EMAIL") == "" || os.Getenv("HELO_NAME") == "" {
+		respondWithTextError(w, r, http.StatusInternalServerError, "FROM_EMAIL and HELO_NAME must be set in environment variables")
 		return
 	}
 
-	verifier := emailVerifier.NewVerifier().
-		EnableSMTPCheck().
-		Proxy(proxyURL).
-		FromEmail(fromEmail).
-		HelloName(heloName)
-
-	ret, err := verifier.Verify(ps.ByName("email"))
+	verifier := sharedVerifier()
+	opts := verifyOptionsFromRequest(r)
+	verification, err := verifier.Verify(r.Context(), email, opts)
 	if err != nil {
 		// http.Error(w, err.Error(), http.StatusInternalServerError)
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, r, verificationErrorStatus(err), err.Error())
 		return
 	}
+	ret := verification.Result
 	if !ret.Syntax.Valid {
+		w.WriteHeader(resultStatus(ret))
 		_, _ = fmt.Fprint(w, "email address syntax is invalid")
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	bytes, err := json.Marshal(ret)
+
+	respOpts := responseOptionsFromRequest(r)
+	respOpts.input = input
+	resp := newVerificationResponse(r.Context(), verification, respOpts)
+	if respOpts.verifySuggestion {
+		resp.SuggestionResult = verifier.suggestionResult(r.Context(), verification, opts, respOpts)
+	}
+	respondWithJSON(w, r, resultStatus(ret), resp)
+}
+
+// GetEmailValidity reports only whether the email passes the
+// deliverability policy, for callers that need nothing but a yes or no
+func GetEmailValidity(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	email := emailParam(ps)
+	if email == "" {
+		respondWithError(w, r, http.StatusBadRequest, "email is required")
+		return
+	}
+	email, err := addressFromInput(email)
 	if err != nil {
-		// http.Error(w, err.Error(), http.StatusInternalServerError)
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	verification, err := sharedVerifier().Verify(r.Context(), email, verifyOptionsFromRequest(r))
+	if err != nil {
+		respondWithError(w, r, verificationErrorStatus(err), err.Error())
+		return
+	}
+
+	valid := policyFromRequest(r).deliverable(verification.Result)
+	respondWithJSON(w, r, resultStatus(verification.Result), map[string]bool{"valid": valid})
+}
+
+// emailParam returns the :email path parameter without surrounding
+// whitespace. Empty when the path has no email, as in /v1//verification.
+func emailParam(ps httprouter.Params) string {
+	return strings.TrimSpace(ps.ByName("email"))
+}
+
+type VerificationRequest struct {
+	Email   string `json:"email"`
+	Options struct {
+		SMTP       *bool `json:"smtp"` // defaults to true
+		Gravatar   bool  `json:"gravatar"`
+		Suggest    bool  `json:"suggest"`
+		Normalize  bool  `json:"normalize"`
+		Force      bool  `json:"force"`       // also set by ?force=true
+		PerAddress bool  `json:"per_address"` // also set by ?per_address=true
+		Passive    bool  `json:"passive"`     // also set by ?passive=true
+		// MXHost replaces the domain's MX records for the SMTP check, a
+		// diagnostic only accepted with DEBUG_ENDPOINTS
+		MXHost string `json:"mx_host"`
+		// VerifySuggestion also verifies the suggested correction, also
+		// set by ?verify_suggestion=true
+		VerifySuggestion bool `json:"verify_suggestion"`
+		SenderOptions
+	} `json:"options"`
+}
+
+// SenderOptions override the identity the SMTP probe presents. Servers may
+// answer differently depending on the sender, so results obtained with an
+// override can differ from the default ones.
+type SenderOptions struct {
+	FromEmail string `json:"from_email"`
+	HeloName  string `json:"helo_name"`
+}
+
+// PostEmailVerification verifies the email in the request body, with the
+// optional checks chosen per request
+func PostEmailVerification(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req VerificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	if req.Email == "" {
+		respondWithError(w, r, http.StatusBadRequest, "email is required")
+		return
+	}
+
+	email, err := addressFromInput(req.Email)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts, respOpts, err := req.options(r)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	verifier := sharedVerifier()
+	verification, err := verifier.Verify(r.Context(), email, opts)
+	if err != nil {
+		respondWithError(w, r, verificationErrorStatus(err), err.Error())
 		return
 	}
 
-	_, _ = fmt.Fprint(w, string(bytes))
+	resp := newVerificationResponse(r.Context(), verification, respOpts)
+	if respOpts.verifySuggestion {
+		resp.SuggestionResult = verifier.suggestionResult(r.Context(), verification, opts, respOpts)
+	}
+	respondWithJSON(w, r, resultStatus(verification.Result), resp)
+}
+
+// options combines the query parameters of r with the options in the
+// request body.
+func (req *VerificationRequest) options(r *http.Request) (verifyOptions, responseOptions, error) {
+	respOpts := responseOptionsFromRequest(r)
+	respOpts.normalize = req.Options.Normalize
+	respOpts.input = req.Email
+	respOpts.verifySuggestion = respOpts.verifySuggestion || req.Options.VerifySuggestion
+	if err := validateSender(req.Options.FromEmail, req.Options.HeloName); err != nil {
+		return verifyOptions{}, respOpts, err
+	}
+	if req.Options.MXHost != "" && !DEBUG_ENDPOINTS {
+		return verifyOptions{}, respOpts, errors.New("mx_host is only accepted with DEBUG_ENDPOINTS")
+	}
+
+	query := verifyOptionsFromRequest(r)
+	opts := verifyOptions{
+		SMTP:      req.Options.SMTP == nil || *req.Options.SMTP,
+		Gravatar:  req.Options.Gravatar,
+		Suggest:   req.Options.Suggest || respOpts.verifySuggestion,
+		Force:     req.Options.Force || query.Force,
+		FromEmail: req.Options.FromEmail,
+		HeloName:  req.Options.HeloName,
+
+		PerAddress: req.Options.PerAddress || query.PerAddress,
+		Passive:    req.Options.Passive || query.Passive,
+		MXHost:     req.Options.MXHost,
+	}
+	return tokenConfigFrom(r.Context()).restrict(opts), respOpts, nil
 }
 
 type BulkVerificationRequest struct {
-	Emails []string `json:"emails"`
+	Emails  []string      `json:"emails"`
+	Options SenderOptions `json:"options"`
+	// OutputPath is where a job writes its results, relative to
+	// JOB_OUTPUT_DIR. Only POST /v1/jobs accepts it.
+	OutputPath string `json:"output_path"`
+	// FailFast answers 502 on the first verification that errors instead
+	// of returning the other results, like ?fail_fast=true. Jobs don't
+	// accept it.
+	FailFast bool `json:"fail_fast"`
 }
 
 type BulkVerificationResult struct {
-	Email  string                `json:"email"`
-	Result *emailVerifier.Result `json:"result,omitempty"`
-	Error  string                `json:"error,omitempty"`
+	Email       string                `json:"email"`
+	Result      *VerificationResponse `json:"result,omitempty"`
+	Error       string                `json:"error,omitempty"`
+	SMTPCode    int                   `json:"smtp_code,omitempty"`    // only with ?smtp_details=true
+	SMTPMessage string                `json:"smtp_message,omitempty"` // only with ?smtp_details=true
+}
+
+// decodeBulkRequest decodes a bulk request body, which is either an object
+// with an "emails" array or a bare JSON array of emails.
+func decodeBulkRequest(body io.Reader) (*BulkVerificationRequest, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, errors.New("Invalid request format")
+	}
+
+	var req BulkVerificationRequest
+	var err error
+	switch trimmed := bytes.TrimSpace(raw); {
+	case len(trimmed) > 0 && trimmed[0] == '[':
+		err = json.Unmarshal(trimmed, &req.Emails)
+	case len(trimmed) > 0 && trimmed[0] == '{':
+		err = json.Unmarshal(trimmed, &req)
+	default:
+		err = errors.New("not an array or object")
+	}
+	if err != nil {
+		return nil, errors.New(`Request body must be an array of emails or an object with an "emails" array`)
+	}
+	return &req, nil
+}
+
+// bulkOptions combines the query parameters of r with the options in the
+// request body.
+func (req *BulkVerificationRequest) bulkOptions(r *http.Request) (bulkOptions, error) {
+	opts := bulkOptionsFromRequest(r)
+	if err := validateSender(req.Options.FromEmail, req.Options.HeloName); err != nil {
+		return opts, err
+	}
+	opts.verify.FromEmail = req.Options.FromEmail
+	opts.verify.HeloName = req.Options.HeloName
+	opts.failFast = opts.failFast || req.FailFast
+	return opts, nil
 }
 
 // BulkEmailVerification handles multiple email verifications
 func BulkEmailVerification(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	w.Header().Set("Content-Type", "application/json")
-
 	// Decode the request body
-	var req BulkVerificationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, `{"error": "Invalid request format"}`, http.StatusBadRequest)
+	req, err := decodeBulkRequest(r.Body)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	verifyBulk(w, r, req)
+}
+
+// BulkTextVerification handles multiple email verifications from a plain
+// text body, with emails separated by newlines or commas
+func BulkTextVerification(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
+	verifyBulk(w, r, &BulkVerificationRequest{Emails: parseEmailList(string(body))})
+}
+
+// parseEmailList splits text on newlines and commas, dropping whitespace
+// and blank entries.
+func parseEmailList(text string) []string {
+	fields := strings.FieldsFunc(text, func(c rune) bool {
+		return c == '\n' || c == '\r' || c == ','
+	})
+	emails := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if email := strings.TrimSpace(field); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+// verifyBulk validates a decoded bulk request and responds with its results.
+func verifyBulk(w http.ResponseWriter, r *http.Request, req *BulkVerificationRequest) {
 	// Validate input
 	if len(req.Emails) == 0 {
-		http.Error(w, `{"error": "No emails provided"}`, http.StatusBadRequest)
+		respondWithError(w, r, http.StatusBadRequest, "No emails provided")
 		return
 	}
-
-	if len(req.Emails) > MAX_EMAILS {
-		http.Error(w, fmt.Sprintf(`{"error": "Too many emails provided (max %d)"}`, MAX_EMAILS), http.StatusBadRequest)
+	if req.OutputPath != "" {
+		respondWithError(w, r, http.StatusBadRequest, "output_path is only accepted by POST /v1/jobs")
 		return
 	}
 
-	// Initialize verifier once for all requests
-	verifier := emailVerifier.NewVerifier().
-		EnableSMTPCheck().
-		Proxy(os.Getenv("PROXY_URL")).
-		FromEmail(os.Getenv("FROM_EMAIL")).
-		HelloName(os.Getenv("HELO_NAME"))
-
-	// Use wait group and mutex for concurrent processing
-	var wg sync.WaitGroup
-	results := make([]BulkVerificationResult, 0, len(req.Emails))
-	var mu sync.Mutex
+	if maxEmails := tokenConfigFrom(r.Context()).maxEmails(); len(req.Emails) > maxEmails {
+		respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("Too many emails provided (max %d)", maxEmails))
+		return
+	}
 
-	for _, email := range req.Emails {
-		wg.Add(1)
-		go func(email string) {
-			defer wg.Done()
+	opts, err := req.bulkOptions(r)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if invalid := invalidBulkEmails(req.Emails); len(invalid) > 0 && !opts.lenient {
+		respondWithInvalidEmails(w, r, invalid)
+		return
+	}
 
-			result, err := verifier.Verify(email)
-			res := BulkVerificationResult{Email: email}
+	emails := req.Emails
+	if opts.keyByEmail {
+		// A map holds a single result per email anyway
+		emails = uniqueEmails(emails)
+	}
 
-			if err != nil {
-				res.Error = err.Error()
-			} else {
-				res.Result = result
-			}
+	ctx, cancel := bulkContext(r.Context())
+	defer cancel()
 
-			mu.Lock()
-			results = append(results, res)
-			mu.Unlock()
-		}(email)
+	// Verify every email concurrently, they are at most MAX_EMAILS
+	outcome := verifyAll(ctx, sharedVerifier(), emails, len(emails), opts, nil)
+	results := outcome.results
+	r = withCacheHits(r, outcome.cacheHits)
+	if opts.byClass {
+		sortByClassification(results)
 	}
 
-	wg.Wait()
-
-	// Marshal and return results
-	response, err := json.Marshal(results)
-	if err != nil {
-		http.Error(w, `{"error": "Failed to format response"}`, http.StatusInternalServerError)
+	if outcome.failed != nil {
+		respondWithErrorDetails(w, r, http.StatusBadGateway, "Verification of "+outcome.failed.Email+" failed", map[string]interface{}{
+			"email":  outcome.failed.Email,
+			"reason": outcome.failed.Error,
+		})
 		return
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write(response)
+	if outcome.reason == bulkReasonQueueTimeout {
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(MAX_QUEUE_WAIT.Seconds()))))
+		respondWithError(w, r, http.StatusServiceUnavailable, "Server busy, timed out waiting for a verification slot")
+		return
+	}
+	if outcome.partial && BULK_SYNC_DEADLINE > 0 && outcome.reason == bulkReasonDeadline {
+		j := startJob(r, outcome.remaining, opts, "")
+		job := j.response()
+		w.Header().Set("Location", "/v1/jobs/"+j.id)
+		respondWithJSON(w, r, http.StatusAccepted, PartialBulkResponse{Partial: true, Reason: outcome.reason, Results: results, Job: &job})
+		return
+	}
+	if outcome.partial {
+		respondWithJSON(w, r, http.StatusOK, PartialBulkResponse{Partial: true, Reason: outcome.reason, Results: results})
+		return
+	}
+	if opts.keyByEmail {
+		respondWithJSON(w, r, http.StatusOK, keyedByEmail(results))
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, results)
 }
 
 func main() {
@@ -166,6 +392,11 @@ func main() {
 		log.Println("No .env file found. Make sure to set environment variables manually.")
 	}
 
+	// Set up before any address can be logged
+	if LOG_REDACT_EMAILS = envBool("LOG_REDACT_EMAILS", false); LOG_REDACT_EMAILS {
+		log.SetOutput(redactingWriter{out: log.Writer()})
+	}
+
 	// Ensure required environment variables are set
 	if os.Getenv("AUTH_TOKEN") == "" {
 		log.Fatal("AUTH_TOKEN environment variable not set")
@@ -174,28 +405,336 @@ func main() {
 		log.Fatal("FROM_EMAIL and HELO_NAME environment variables must be set")
 	}
 
+	currentSettings.Store(loadSettings())
+	go reloadOnSIGHUP()
+
+	if tokens, err = loadTokens(os.Getenv("TOKENS_CONFIG")); err != nil {
+		log.Fatal(err)
+	}
+	defaultTokenConfig.id = tokenFingerprint(os.Getenv("AUTH_TOKEN"))
+	if classificationRules, err = loadClassificationRules(os.Getenv("CLASSIFICATION_RULES")); err != nil {
+		log.Fatal(err)
+	}
+
+	ABUSE_WEBHOOK_URL = os.Getenv("ABUSE_WEBHOOK_URL")
+	ABUSE_THRESHOLD = envFloat("ABUSE_THRESHOLD", ABUSE_THRESHOLD)
+	ABUSE_MIN_EMAILS = envInt("ABUSE_MIN_EMAILS", ABUSE_MIN_EMAILS)
+	ABUSE_WINDOW = envDuration("ABUSE_WINDOW", ABUSE_WINDOW)
+
+	if BROKER_URL = os.Getenv("BROKER_URL"); BROKER_URL != "" {
+		if broker, err = newPublisher(BROKER_URL); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if topic := os.Getenv("BROKER_TOPIC"); topic != "" {
+		BROKER_TOPIC = topic
+	}
+
+	STORE_BUFFER = envInt("STORE_BUFFER", STORE_BUFFER)
+	STORE_BATCH_SIZE = envInt("STORE_BATCH_SIZE", STORE_BATCH_SIZE)
+	STORE_FLUSH_INTERVAL = envDuration("STORE_FLUSH_INTERVAL", STORE_FLUSH_INTERVAL)
+	if DATABASE_URL = os.Getenv("DATABASE_URL"); DATABASE_URL != "" {
+		if store, err = openResultStore(DATABASE_URL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	REQUEST_TIMEOUT = envDuration("REQUEST_TIMEOUT", REQUEST_TIMEOUT)
+	MIN_RESPONSE_TIME = envDuration("MIN_RESPONSE_TIME", 0)
+
+	// PROXY_URLS configures a pool of proxies, PROXY_URL a single one
+	proxyURLs := envList("PROXY_URLS")
+	if len(proxyURLs) == 0 && os.Getenv("PROXY_URL") != "" {
+		proxyURLs = []string{os.Getenv("PROXY_URL")}
+	}
+	for _, proxyURL := range proxyURLs {
+		if err := validateProxyURL(proxyURL); err != nil {
+			log.Fatal(err)
+		}
+	}
+	proxies = newProxyPool(proxyURLs, envInt("PROXY_MAX_CONCURRENCY", 0))
+	PROXY_MX_MAX_CONCURRENCY = envInt("PROXY_MX_MAX_CONCURRENCY", PROXY_MX_MAX_CONCURRENCY)
+	proxyMXSlots = newProxyMXLimiter(PROXY_MX_MAX_CONCURRENCY)
+	REQUIRE_PROXY = envBool("REQUIRE_PROXY", false)
+	SKIP_SMTP_FOR_FREE = envBool("SKIP_SMTP_FOR_FREE", false)
+	SMTP_EMPTY_SENDER = envBool("SMTP_EMPTY_SENDER", false)
+	if !SMTP_EMPTY_SENDER {
+		go checkSenderSPF(os.Getenv("FROM_EMAIL"), proxyURLs)
+	}
+	if len(proxyURLs) == 0 {
+		if REQUIRE_PROXY {
+			log.Println("WARNING: no proxy configured and REQUIRE_PROXY is set, SMTP checks are disabled")
+		} else {
+			log.Println("WARNING: no proxy configured, SMTP checks connect directly and fail where outbound port 25 is blocked")
+		}
+	}
+
+	cacheTTL := envDuration("CACHE_TTL", 0)
+	cache = newResultCache(cacheTTLs{
+		Valid:   envDuration("CACHE_TTL_VALID", cacheTTL),
+		Invalid: envDuration("CACHE_TTL_INVALID", cacheTTL),
+		Unknown: envDuration("CACHE_TTL_UNKNOWN", cacheTTL),
+	})
+
+	JOB_INLINE_MAX_BYTES = envInt("JOB_INLINE_MAX_BYTES", JOB_INLINE_MAX_BYTES)
+	JOB_TTL = envDuration("JOB_TTL", JOB_TTL)
+	JOB_OUTPUT_DIR = os.Getenv("JOB_OUTPUT_DIR")
+	go jobs.sweep()
+
+	BULK_CANCEL_GRACE = envDuration("BULK_CANCEL_GRACE", BULK_CANCEL_GRACE)
+	BULK_SYNC_DEADLINE = envDuration("BULK_SYNC_DEADLINE", BULK_SYNC_DEADLINE)
+
+	HTTP_TIMEOUT = envDuration("HTTP_TIMEOUT", HTTP_TIMEOUT)
+	HTTP_MAX_IDLE_CONNS_PER_HOST = envInt("HTTP_MAX_IDLE_CONNS_PER_HOST", HTTP_MAX_IDLE_CONNS_PER_HOST)
+	HTTP_IDLE_CONN_TIMEOUT = envDuration("HTTP_IDLE_CONN_TIMEOUT", HTTP_IDLE_CONN_TIMEOUT)
+	httpClient = newHTTPClient()
+
+	if gravatarURL := os.Getenv("GRAVATAR_URL"); gravatarURL != "" {
+		GRAVATAR_URL = gravatarURL
+	}
+	GRAVATAR_CONCURRENCY = envInt("GRAVATAR_CONCURRENCY", GRAVATAR_CONCURRENCY)
+	GRAVATAR_CACHE_TTL = envDuration("GRAVATAR_CACHE_TTL", GRAVATAR_CACHE_TTL)
+	gravatars = newGravatarChecker(GRAVATAR_CONCURRENCY, GRAVATAR_CACHE_TTL)
+	if GRAVATAR_CACHE_TTL > 0 {
+		go gravatars.sweep()
+	}
+
+	DNS_CACHE_TTL = envDuration("DNS_CACHE_TTL", DNS_CACHE_TTL)
+	DNS_CONCURRENCY = envInt("DNS_CONCURRENCY", DNS_CONCURRENCY)
+	DNS_RETRY_COUNT = envInt("DNS_RETRY_COUNT", DNS_RETRY_COUNT)
+	DNS_RETRY_BACKOFF = envDuration("DNS_RETRY_BACKOFF", DNS_RETRY_BACKOFF)
+	resolver = newMXResolver(DNS_CONCURRENCY, DNS_CACHE_TTL)
+	if DNS_CACHE_TTL > 0 {
+		go resolver.sweep()
+	}
+
+	if rdapURL := os.Getenv("RDAP_URL"); rdapURL != "" {
+		RDAP_URL = rdapURL
+	}
+	DOMAIN_AGE_CACHE_TTL = envDuration("DOMAIN_AGE_CACHE_TTL", DOMAIN_AGE_CACHE_TTL)
+	YOUNG_DOMAIN_DAYS = envInt("YOUNG_DOMAIN_DAYS", YOUNG_DOMAIN_DAYS)
+	go domainAges.sweep()
+
+	CATCH_ALL_CACHE_TTL = envDuration("CATCH_ALL_CACHE_TTL", CATCH_ALL_CACHE_TTL)
+	if CATCH_ALL_CACHE_TTL > 0 {
+		go catchAlls.sweep()
+	}
+
+	DOMAIN_REPUTATION_TTL = envDuration("DOMAIN_REPUTATION_TTL", 0)
+	DOMAIN_TIMEOUT_THRESHOLD = envInt("DOMAIN_TIMEOUT_THRESHOLD", DOMAIN_TIMEOUT_THRESHOLD)
+	if DOMAIN_REPUTATION_TTL > 0 {
+		go domains.sweep()
+	}
+
+	SMTP_COMMAND_DELAY = envDuration("SMTP_COMMAND_DELAY", 0)
+	SMTP_JITTER_MAX = envDuration("SMTP_JITTER_MAX", SMTP_JITTER_MAX)
+	if IP_NETWORK, err = ipNetwork(os.Getenv("IPV6_PREFERENCE")); err != nil {
+		log.Fatal(err)
+	}
+	BULK_CONCURRENCY = envInt("BULK_CONCURRENCY", BULK_CONCURRENCY)
+	bulkSlots = newFairScheduler(BULK_CONCURRENCY)
+	JOB_CONCURRENCY = envInt("JOB_CONCURRENCY", JOB_CONCURRENCY)
+	jobSlots = newFairScheduler(JOB_CONCURRENCY)
+	MAX_QUEUE_WAIT = envDuration("MAX_QUEUE_WAIT", MAX_QUEUE_WAIT)
+	EMAIL_TOTAL_BUDGET = envDuration("EMAIL_TOTAL_BUDGET", EMAIL_TOTAL_BUDGET)
+	SMTP_STARTTLS = envBool("SMTP_STARTTLS", SMTP_STARTTLS)
+	SMTP_TLS_INSECURE = envBool("SMTP_TLS_INSECURE", SMTP_TLS_INSECURE)
+	if SMTP_TLS_INSECURE && SMTP_STARTTLS {
+		log.Println("WARNING: SMTP_TLS_INSECURE is set, STARTTLS certificates are not verified")
+	}
+	MX_TRY_LIMIT = envInt("MX_TRY_LIMIT", MX_TRY_LIMIT)
+	REJECT_PRIVATE_MX = envBool("REJECT_PRIVATE_MX", REJECT_PRIVATE_MX)
+	INTERNAL_DOMAINS = envList("INTERNAL_DOMAINS")
+	SMTP_BREAKER_THRESHOLD = envInt("SMTP_BREAKER_THRESHOLD", SMTP_BREAKER_THRESHOLD)
+	SMTP_BREAKER_COOLDOWN = envDuration("SMTP_BREAKER_COOLDOWN", SMTP_BREAKER_COOLDOWN)
+	smtpBreaker = newSMTPBreaker(SMTP_BREAKER_THRESHOLD, SMTP_BREAKER_COOLDOWN)
+	if DEGRADE_ORDER, err = parseDegradeOrder(envList("DEGRADE_ORDER")); err != nil {
+		log.Fatal(err)
+	}
+	NORMALIZE_LOCAL_PART = envBool("NORMALIZE_LOCAL_PART", NORMALIZE_LOCAL_PART)
+	NORMALIZE_UNICODE = envBool("NORMALIZE_UNICODE", NORMALIZE_UNICODE)
+	HOMOGRAPH_CHECK = envBool("HOMOGRAPH_CHECK", HOMOGRAPH_CHECK)
+	CHECK_TLD = envBool("CHECK_TLD", CHECK_TLD)
+	REJECT_ROLE_ACCOUNTS = envBool("REJECT_ROLE_ACCOUNTS", REJECT_ROLE_ACCOUNTS)
+	if subaddressSeparators, err = loadSubaddressSeparators(os.Getenv("SUBADDRESS_SEPARATORS")); err != nil {
+		log.Fatal(err)
+	}
+	if SYNTAX_MODE, err = parseSyntaxMode(os.Getenv("SYNTAX_MODE")); err != nil {
+		log.Fatal(err)
+	}
+	if RESULT_STATUS_MODE, err = parseResultStatusMode(os.Getenv("RESULT_STATUS_MODE")); err != nil {
+		log.Fatal(err)
+	}
+
 	router := httprouter.New()
 
-	// Use the middleware for token verification
-	router.GET("/v1/:email/verification", verifyToken(GetEmailVerification))
-	router.POST("/v1/bulk", verifyToken(BulkEmailVerification))
+	// GET routes under /v1/ with a static first segment would conflict with
+	// the :email parameter, so they live in their own router tried first
+	resources := httprouter.New()
+	emails := httprouter.New()
+	router.GET("/v1/*path", firstMatch(resources, emails))
+
+	// Use the middleware for token verification. Verification endpoints
+	// are turned off in maintenance mode.
+	emails.GET("/v1/:email/verification", withMaintenance(verifyToken(withDebugSampling(withTimeout(GetEmailVerification)))))
+	emails.GET("/v1/:email/valid", withMaintenance(verifyToken(withDebugSampling(withTimeout(GetEmailValidity)))))
+	router.POST("/v1/verify", withMaintenance(verifyToken(withDebugSampling(withTimeout(PostEmailVerification)))))
+	router.POST("/v1/bulk", withMaintenance(verifyToken(withDebugSampling(withTimeout(BulkEmailVerification)))))
+	router.POST("/v1/bulk/text", withMaintenance(verifyToken(withDebugSampling(withTimeout(BulkTextVerification)))))
+	// Not wrapped with withTimeout, the lines are streamed both ways
+	router.POST("/v1/bulk/jsonl", withMaintenance(verifyToken(withDebugSampling(BulkJSONLVerification))))
+	router.POST("/v1/bulk/disposable", withMaintenance(verifyToken(withTimeout(BulkDisposableCheck))))
+	router.POST("/v1/jobs", withMaintenance(verifyToken(withDebugSampling(withTimeout(CreateJob)))))
+	router.POST("/rpc", withMaintenance(verifyToken(withDebugSampling(withTimeout(RPC)))))
+	resources.GET("/v1/domain/:domain/catchall", withMaintenance(verifyToken(withDebugSampling(withTimeout(GetDomainCatchAll)))))
+	resources.GET("/v1/jobs/:id", verifyToken(withTimeout(GetJob)))
+	resources.GET("/v1/auth/check", verifyToken(GetAuthCheck))
+	resources.GET("/v1/cache/stats", verifyToken(GetCacheStats))
+	if CACHE_ADMIN_TOKEN = os.Getenv("CACHE_ADMIN_TOKEN"); CACHE_ADMIN_TOKEN != "" {
+		router.DELETE("/v1/cache/:email", verifyAdminToken(DeleteCachedEmail))
+		router.POST("/v1/cache/flush", verifyAdminToken(FlushCache))
+	}
+	// Not wrapped with withTimeout, large results are written in chunks
+	resources.GET("/v1/jobs/:id/download", verifyToken(DownloadJobResults))
+
+	router.GET("/config", verifyToken(GetConfig))
+	router.GET("/stats", verifyToken(GetStats))
+	router.GET("/healthz", GetHealth)
+	router.GET("/version", GetVersion)
+
+	DEBUG_ENDPOINTS = envBool("DEBUG_ENDPOINTS", false)
+	if DEBUG_ENDPOINTS {
+		log.Println("WARNING: DEBUG_ENDPOINTS is set, /debug/ endpoints expose cached addresses")
+		router.GET("/debug/cache", verifyToken(GetDebugCache))
+		router.GET("/debug/smtp", verifyToken(withTimeout(GetDebugSMTP)))
+	}
+
+	RESPONSE_ENVELOPE = envBool("RESPONSE_ENVELOPE", false)
+	headers, err := parseResponseHeaders(os.Getenv("RESPONSE_HEADERS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	TLS_CERT_FILE = os.Getenv("TLS_CERT_FILE")
+	TLS_KEY_FILE = os.Getenv("TLS_KEY_FILE")
+	if (TLS_CERT_FILE == "") != (TLS_KEY_FILE == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if TLS_MIN_VERSION, err = parseTLSVersion(os.Getenv("TLS_MIN_VERSION")); err != nil {
+		log.Fatal(err)
+	}
+	if TLS_CIPHER_SUITES, err = parseCipherSuites(envList("TLS_CIPHER_SUITES")); err != nil {
+		log.Fatal(err)
+	}
+
+	MAX_HEADER_BYTES = envInt("MAX_HEADER_BYTES", MAX_HEADER_BYTES)
+	HTTP_KEEP_ALIVES = envBool("HTTP_KEEP_ALIVES", HTTP_KEEP_ALIVES)
 
 	server := &http.Server{
 		Addr:         ":8080",
-		Handler:      router,
+		Handler:      withResponseHeaders(withRequestMeta(router), headers),
 		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		WriteTimeout: max(30*time.Second, REQUEST_TIMEOUT+5*time.Second),
+		TLSConfig:    serverTLSConfig(),
+
+		MaxHeaderBytes: MAX_HEADER_BYTES,
 	}
+	server.SetKeepAlivesEnabled(HTTP_KEEP_ALIVES)
 
+	if TLS_CERT_FILE != "" {
+		log.Printf("Server is running on port 8080 with TLS %s or later...", tlsVersionName(TLS_MIN_VERSION))
+		log.Fatal(server.ListenAndServeTLS(TLS_CERT_FILE, TLS_KEY_FILE))
+	}
 	log.Println("Server is running on port 8080...")
 	log.Fatal(server.ListenAndServe())
 }
 
-func respondWithError(w http.ResponseWriter, status int, errMsg string) {
-	response := map[string]string{"error": errMsg}
+// firstMatch serves a request with the first of routers that has a route
+// for it. httprouter rejects a static path segment where another route has
+// a parameter, so routes like /v1/jobs/:id and /v1/:email/verification are
+// registered on separate routers combined with firstMatch.
+func firstMatch(routers ...*httprouter.Router) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		// Routes are matched on the escaped path and the parameters decoded
+		// afterwards, so an encoded slash in a local part stays in :email
+		for _, router := range routers {
+			if handle, ps, _ := router.Lookup(r.Method, r.URL.EscapedPath()); handle != nil {
+				for i := range ps {
+					if value, err := url.PathUnescape(ps[i].Value); err == nil {
+						ps[i].Value = value
+					}
+				}
+				handle(w, r, ps)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}
+}
+
+func respondWithError(w http.ResponseWriter, r *http.Request, status int, errMsg string) {
+	respondWithErrorDetails(w, r, status, errMsg, nil)
+}
+
+// respondWithErrorDetails writes an error response carrying details next to
+// the error message, or in data with RESPONSE_ENVELOPE.
+func respondWithErrorDetails(w http.ResponseWriter, r *http.Request, status int, errMsg string, details map[string]interface{}) {
+	writeJSON(w, r, status, errorBody(r, errMsg, details))
+}
+
+// errorBody is the body of an error response.
+func errorBody(r *http.Request, errMsg string, details map[string]interface{}) interface{} {
+	if RESPONSE_ENVELOPE {
+		var data interface{}
+		if details != nil {
+			data = details
+		}
+		return newEnvelope(r, data, errMsg)
+	}
+	body := map[string]interface{}{"error": errMsg}
+	for name, v := range details {
+		body[name] = v
+	}
+	return body
+}
+
+// respondWithTextError writes a plain text error like http.Error, or a JSON
+// one with RESPONSE_ENVELOPE.
+func respondWithTextError(w http.ResponseWriter, r *http.Request, status int, errMsg string) {
+	if RESPONSE_ENVELOPE {
+		respondWithError(w, r, status, errMsg)
+		return
+	}
+	http.Error(w, errMsg, status)
+}
+
+// respondWithJSON writes v as the JSON response body with the given status,
+// wrapped in a ResponseEnvelope with RESPONSE_ENVELOPE.
+func respondWithJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if RESPONSE_ENVELOPE {
+		v = newEnvelope(r, v, "")
+	}
+	writeJSON(w, r, status, v)
+}
+
+// writeJSON writes v as the JSON response body as is.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := encodeJSON(r, v)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to format response"}`, http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
+	w.Write(body)
+}
 
-	json.NewEncoder(w).Encode(response)
-}
\ No newline at end of file
+// encodeJSON marshals v, indenting the output when the request asks for it
+// with ?pretty=true. Compact output stays the default since it is smaller.
+func encodeJSON(r *http.Request, v interface{}) ([]byte, error) {
+	if r.URL.Query().Get("pretty") == "true" {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+	"github.com/julienschmidt/httprouter"
+)
+
+// stubVerifier makes the handlers verify with run instead of the network
+// checks for the rest of the test, starting from an empty result cache.
+func stubVerifier(t *testing.T, run verifyFunc) {
+	t.Helper()
+	oldVerifier, oldCache := sharedVerifier, cache
+	t.Cleanup(func() { sharedVerifier, cache = oldVerifier, oldCache })
+
+	verifier := &Verifier{run: run}
+	sharedVerifier = func() *Verifier { return verifier }
+	cache = newResultCache(cacheTTLs{Valid: time.Minute, Invalid: time.Minute, Unknown: time.Minute})
+	currentSettings.Store(loadSettings())
+}
+
+// deliverableVerification is the canned outcome of a deliverable email.
+func deliverableVerification(_ context.Context, email string, _ verifyOptions) (*Verification, error) {
+	local, domain, _ := strings.Cut(email, "@")
+	return &Verification{
+		Result: &emailVerifier.Result{
+			Email:        email,
+			Reachable:    reachableYes,
+			Syntax:       emailVerifier.Syntax{Username: local, Domain: domain, Valid: true},
+			HasMxRecords: true,
+			SMTP:         &emailVerifier.SMTP{HostExists: true, Deliverable: true},
+		},
+		VerifiedAt: time.Now(),
+		MXTTL:      -1,
+	}, nil
+}
+
+// countingVerifier wraps run, counting the verifications of each email.
+type countingVerifier struct {
+	mu    sync.Mutex
+	calls map[string]int
+	run   verifyFunc
+}
+
+func (c *countingVerifier) verify(ctx context.Context, email string, opts verifyOptions) (*Verification, error) {
+	c.mu.Lock()
+	if c.calls == nil {
+		c.calls = map[string]int{}
+	}
+	c.calls[email]++
+	c.mu.Unlock()
+	return c.run(ctx, email, opts)
+}
+
+// postBulk sends emails to BulkEmailVerification and decodes its results.
+func postBulk(t *testing.T, emails []string) []BulkVerificationResult {
+	t.Helper()
+	body, _ := json.Marshal(map[string][]string{"emails": emails})
+	w := httptest.NewRecorder()
+	BulkEmailVerification(w, httptest.NewRequest(http.MethodPost, "/v1/bulk", strings.NewReader(string(body))), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /v1/bulk answered %d: %s", w.Code, w.Body)
+	}
+	var results []BulkVerificationResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	return results
+}
+
+func TestBulkVerificationStubbed(t *testing.T) {
+	counter := &countingVerifier{run: deliverableVerification}
+	stubVerifier(t, counter.verify)
+
+	emails := []string{"b@example.com", "a@example.com", "b@example.com"}
+	results := postBulk(t, emails)
+	if len(results) != len(emails) {
+		t.Fatalf("got %d results, want %d", len(results), len(emails))
+	}
+	for i, res := range results {
+		if res.Email != emails[i] || res.Result == nil || !res.Result.Deliverable {
+			t.Errorf("result %d = %+v, want %s deliverable", i, res, emails[i])
+		}
+	}
+	if counter.calls["a@example.com"] != 1 || counter.calls["b@example.com"] != 1 {
+		t.Errorf("verifications = %v, want each email verified once", counter.calls)
+	}
+
+	// Verified emails are answered from the cache afterwards
+	postBulk(t, []string{"a@example.com"})
+	if counter.calls["a@example.com"] != 1 {
+		t.Errorf("a@example.com verified %d times, want the cached result", counter.calls["a@example.com"])
+	}
+}
+
+func TestEmailPathParameter(t *testing.T) {
+	t.Setenv("FROM_EMAIL", "probe@example.com")
+	t.Setenv("HELO_NAME", "example.com")
+	counter := &countingVerifier{run: deliverableVerification}
+	stubVerifier(t, counter.verify)
+
+	// Routed as in main
+	emails := httprouter.New()
+	emails.GET("/v1/:email/verification", GetEmailVerification)
+	emails.GET("/v1/:email/valid", GetEmailValidity)
+	router := httprouter.New()
+	router.GET("/v1/*path", firstMatch(httprouter.New(), emails))
+
+	tests := []struct {
+		path   string
+		status int
+		email  string // verified address, when any
+	}{
+		{"/v1//verification", http.StatusBadRequest, ""},
+		{"/v1/%20/verification", http.StatusBadRequest, ""},
+		{"/v1//valid", http.StatusBadRequest, ""},
+		{"/v1/john%40example.com/verification", http.StatusOK, "john@example.com"},
+		{"/v1/%20jane@example.com%20/verification", http.StatusOK, "jane@example.com"},
+		{"/v1/a%2Fb%40example.com/verification", http.StatusOK, "a/b@example.com"},
+		{"/v1/a%2Bb%40example.com/valid", http.StatusOK, "a+b@example.com"},
+		{"/v1/John%20Doe%20%3Cjd%40example.com%3E/verification", http.StatusOK, "jd@example.com"},
+	}
+	for _, tt := range tests {
+		counter.calls = nil
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %s answered %d, want %d: %s", tt.path, w.Code, tt.status, w.Body)
+		}
+		if tt.email == "" {
+			if len(counter.calls) > 0 {
+				t.Errorf("GET %s verified %v", tt.path, counter.calls)
+			}
+		} else if counter.calls[tt.email] != 1 {
+			t.Errorf("GET %s verified %v, want %s", tt.path, counter.calls, tt.email)
+		}
+	}
+}
+
+func TestVerifyTokenDoesNotLogTokens(t *testing.T) {
+	t.Setenv("AUTH_TOKEN", "expected-secret")
+	var logs strings.Builder
+	defer func(out io.Writer) { log.SetOutput(out) }(log.Writer())
+	log.SetOutput(&logs)
+
+	handler := verifyToken(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for token, status := range map[string]int{"": http.StatusUnauthorized, "received-secret": http.StatusForbidden, "expected-secret": http.StatusNoContent} {
+		r := httptest.NewRequest(http.MethodGet, "/v1/auth/check", nil)
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+		if w.Code != status {
+			t.Errorf("token %q: answered %d, want %d", token, w.Code, status)
+		}
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Errorf("tokens logged:\n%s", logs.String())
+	}
+}
+
+func TestForcedVerificationsSkipCacheStats(t *testing.T) {
+	stubVerifier(t, deliverableVerification)
+	verifier := sharedVerifier()
+	ctx := context.Background()
+	if _, err := verifier.Verify(ctx, "a@example.com", verifyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []verifyOptions{{Force: true}, {MXHost: "mx.example.com"}} {
+		verification, err := verifier.Verify(ctx, "a@example.com", opts)
+		if err != nil || verification.Cached {
+			t.Errorf("%+v: verification served from the cache, %v", opts, err)
+		}
+	}
+	if hits, misses := cache.hits.Load(), cache.misses.Load(); hits != 0 || misses != 1 {
+		t.Errorf("%d hits and %d misses, want the first lookup only", hits, misses)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var REQUEST_TIMEOUT = 25 * time.Second
+
+// MIN_RESPONSE_TIME holds back the responses of requests answered faster,
+// which paces clients sending each request as soon as the last one is
+// answered, whatever the rate limits say. Only endpoints with a timeout
+// are held back, and never beyond it. Zero disables it.
+var MIN_RESPONSE_TIME time.Duration
+
+// withTimeout puts a hard ceiling of requestTimeout on the time spent
+// handling a request, answering 503 with a JSON error once it is exceeded.
+// Bulk verifications return their partial results shortly before it.
+// Faster responses are held back until MIN_RESPONSE_TIME.
+// Streaming endpoints must not be wrapped: TimeoutHandler buffers the whole
+// response until the handler returns.
+func withTimeout(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		timeout, err := requestTimeout(r)
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		body, _ := encodeJSON(r, errorBody(r, "Request timed out", nil))
+		handler := http.TimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next(w, r, ps)
+			holdBack(r)
+		}), timeout, string(body))
+
+		handler.ServeHTTP(timeoutBodyWriter{w}, r)
+	}
+}
+
+// timeoutBodyWriter labels the error body TimeoutHandler writes without a
+// Content-Type as JSON. The handler's own responses keep their headers,
+// TimeoutHandler copying them over before the status is written.
+type timeoutBodyWriter struct {
+	http.ResponseWriter
+}
+
+func (w timeoutBodyWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// holdBack waits until MIN_RESPONSE_TIME has passed since r started, the
+// response being sent by TimeoutHandler once it returns. It stops shortly
+// before the request times out, which would replace the response with the
+// timeout error.
+func holdBack(r *http.Request) {
+	wait := MIN_RESPONSE_TIME - time.Since(requestMetaFrom(r.Context()).start)
+	if deadline, ok := r.Context().Deadline(); ok {
+		wait = min(wait, time.Until(deadline)-100*time.Millisecond)
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// requestTimeout is REQUEST_TIMEOUT, or the shorter one a client asks for
+// with the X-Max-Duration header, such as "5s" or "1500ms", to get a
+// faster if less complete answer. Longer ones are clamped to
+// REQUEST_TIMEOUT.
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	header := r.Header.Get("X-Max-Duration")
+	if header == "" {
+		return REQUEST_TIMEOUT, nil
+	}
+	d, err := time.ParseDuration(header)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid X-Max-Duration %q, must be a positive duration such as 5s", header)
+	}
+	return min(d, REQUEST_TIMEOUT), nil
+}
+
+// withMaintenance answers 503 while MAINTENANCE_MODE is on, telling clients
+// to retry after MAINTENANCE_RETRY_AFTER.
+func withMaintenance(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if s := runtimeSettings(); s.MaintenanceMode {
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.MaintenanceRetryAfter.Seconds())))
+			respondWithError(w, r, http.StatusServiceUnavailable, "maintenance")
+			return
+		}
+		next(w, r, ps)
+	}
+}
+
+// defaultResponseHeaders are set on every response unless RESPONSE_HEADERS
+// overrides them. An empty value in RESPONSE_HEADERS removes a default.
+var defaultResponseHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+}
+
+// parseResponseHeaders merges the JSON object of RESPONSE_HEADERS, mapping
+// header names to values, into the defaults.
+func parseResponseHeaders(value string) (map[string]string, error) {
+	headers := map[string]string{}
+	for name, v := range defaultResponseHeaders {
+		headers[name] = v
+	}
+	if value == "" {
+		return headers, nil
+	}
+
+	var custom map[string]string
+	if err := json.Unmarshal([]byte(value), &custom); err != nil {
+		return nil, fmt.Errorf("invalid RESPONSE_HEADERS, must be a JSON object of strings: %w", err)
+	}
+	for name, v := range custom {
+		name = http.CanonicalHeaderKey(name)
+		if v == "" {
+			delete(headers, name)
+		} else {
+			headers[name] = v
+		}
+	}
+	return headers, nil
+}
+
+// withResponseHeaders sets headers on every response, before the handler
+// runs so it can still override them.
+func withResponseHeaders(next http.Handler, headers map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
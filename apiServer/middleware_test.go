@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestWithTimeoutContentType(t *testing.T) {
+	defer func(timeout time.Duration) { REQUEST_TIMEOUT = timeout }(REQUEST_TIMEOUT)
+	REQUEST_TIMEOUT = 50 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		handler     httprouter.Handle
+		status      int
+		contentType string
+	}{
+		{"plain text", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, "email address syntax is invalid")
+		}, http.StatusUnprocessableEntity, "text/plain"},
+		{"JSON", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			respondWithJSON(w, r, http.StatusOK, map[string]bool{"valid": true})
+		}, http.StatusOK, "application/json"},
+		{"timed out", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			<-r.Context().Done()
+		}, http.StatusServiceUnavailable, "application/json"},
+	}
+	for _, tt := range tests {
+		// Served for real, the recorder doesn't sniff the Content-Type
+		handler := withTimeout(tt.handler)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r, nil)
+		}))
+		resp, err := http.Get(srv.URL)
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: answered %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+			t.Errorf("%s: Content-Type %q, want %s", tt.name, got, tt.contentType)
+		}
+	}
+}
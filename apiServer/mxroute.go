@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+// REJECT_PRIVATE_MX fails the verification of addresses whose MX hosts
+// only resolve to private, loopback or link-local addresses, which can't
+// receive mail from the internet, instead of probing them. Direct SMTP
+// connections to such addresses are refused too, so crafted domains can't
+// make the server probe internal hosts. Connections through a proxy are
+// resolved by the proxy and only covered by the MX check.
+var REJECT_PRIVATE_MX = true
+
+// ErrMXNotRoutable is the error of verifications rejected by
+// REJECT_PRIVATE_MX.
+const ErrMXNotRoutable = "mx_not_routable"
+
+// routableIP reports whether ip is reachable from the public internet.
+func routableIP(ip net.IP) bool {
+	return !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// checkMXRoutable returns an ErrMXNotRoutable error when every address the
+// MX hosts resolve to is non-routable. Hosts that fail to resolve are left
+// to the SMTP check to report.
+func checkMXRoutable(ctx context.Context, records []*net.MX) error {
+	var resolved []string
+	for _, mx := range records {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, mx.Host)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if routableIP(addr.IP) {
+				return nil
+			}
+			resolved = append(resolved, addr.IP.String())
+		}
+	}
+	if len(resolved) == 0 {
+		return nil
+	}
+	return &emailVerifier.LookupError{
+		Message: ErrMXNotRoutable,
+		Details: fmt.Sprintf("MX hosts only resolve to non-routable addresses %v", resolved),
+	}
+}
+
+// refuseNonRoutable is a net.Dialer Control function refusing connections
+// to non-routable addresses.
+func refuseNonRoutable(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && !routableIP(ip) {
+		return &emailVerifier.LookupError{
+			Message: ErrMXNotRoutable,
+			Details: "refusing to connect to non-routable address " + host,
+		}
+	}
+	return nil
+}
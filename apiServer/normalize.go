@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NORMALIZE_LOCAL_PART lowercases the local part as well as the domain,
+// and matches addresses case-insensitively when caching and deduplicating
+// them. RFC 5321 leaves the local part case-sensitive, only the receiving
+// host may decide that John@example.com and john@example.com are the same
+// mailbox. Nearly every provider does, but some hosts don't, so with this
+// flag the two may share a result that is wrong for one of them. Enable it
+// only when the systems consuming the results also ignore case. When set,
+// every response carries normalized_email.
+var NORMALIZE_LOCAL_PART bool
+
+// NORMALIZE_UNICODE matches addresses by their Unicode NFC form when caching
+// and deduplicating them, so a local part written with composed characters
+// and the same one written with combining marks share a result. The SMTP
+// check still uses the address as given, since servers may not consider the
+// two forms equal, and responses carry email_nfc when it differs.
+var NORMALIZE_UNICODE bool
+
+// normalizeEmail builds the canonical form of a validated address: the
+// local part as given, or lowercased with NORMALIZE_LOCAL_PART, and the
+// domain lowercased in its Unicode form, all in NFC with NORMALIZE_UNICODE.
+func normalizeEmail(localPart, domain string) string {
+	if NORMALIZE_LOCAL_PART {
+		localPart = strings.ToLower(localPart)
+	}
+	return nfc(localPart + "@" + strings.ToLower(domain))
+}
+
+// matchKey is the form under which email is compared, see addressKey.
+func matchKey(email string) string {
+	if NORMALIZE_LOCAL_PART {
+		email = strings.ToLower(email)
+	}
+	return nfc(email)
+}
+
+// addressKey is the key under which email is cached and deduplicated: its
+// matchKey once Verify has dropped a trailing dot from the domain.
+func addressKey(email string) string {
+	return matchKey(trimTrailingDot(email))
+}
+
+// nfc returns the NFC form of s with NORMALIZE_UNICODE, and s otherwise.
+func nfc(s string) string {
+	if NORMALIZE_UNICODE {
+		return norm.NFC.String(s)
+	}
+	return s
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProxyPoolAcquireStopsWithContext(t *testing.T) {
+	pool := newProxyPool([]string{"socks5://a:1080", "socks5://b:1080"}, 1)
+	_, releaseA, err := pool.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, releaseB, err := pool.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := pool.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquiring from a saturated pool returned %v, want the deadline", err)
+	}
+
+	releaseA()
+	proxyURL, release, err := pool.acquire(context.Background())
+	if err != nil || proxyURL != "socks5://a:1080" {
+		t.Errorf("acquired %q, %v after a release, want the released proxy", proxyURL, err)
+	}
+	release()
+	releaseB()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// PROXY_MX_MAX_CONCURRENCY caps the SMTP connections open to a single MX
+// host through the same proxy, direct connections counting as one proxy.
+// Many simultaneous connections from one address to one MX are what gets
+// proxies blocked, and neither PROXY_MAX_CONCURRENCY nor the MX hosts alone
+// prevent them. Connections over the cap wait for a slot, meanwhile the
+// domain's other MX hosts are still dialed. Unlimited when zero.
+var PROXY_MX_MAX_CONCURRENCY = 0
+
+// proxyMXSlots limits the connections of every proxy and MX host pair.
+var proxyMXSlots = newProxyMXLimiter(PROXY_MX_MAX_CONCURRENCY)
+
+type proxyMXKey struct {
+	proxyURL string
+	host     string
+}
+
+// proxyMXLimiter is a semaphore per proxy and MX host pair. Pairs exist only
+// while connections hold or wait for their slots, so the MX hosts of every
+// verified domain don't accumulate.
+type proxyMXLimiter struct {
+	max   int
+	mu    sync.Mutex
+	pairs map[proxyMXKey]*proxyMXPair
+}
+
+type proxyMXPair struct {
+	slots chan struct{}
+	users int // connections holding or waiting for a slot
+}
+
+// newProxyMXLimiter creates a limiter of max connections per pair. A max of
+// zero or less leaves the pairs unlimited.
+func newProxyMXLimiter(max int) *proxyMXLimiter {
+	return &proxyMXLimiter{max: max, pairs: map[proxyMXKey]*proxyMXPair{}}
+}
+
+// acquire waits for a slot of the pair of proxyURL and host, or until ctx is
+// done. The returned func releases the slot.
+func (l *proxyMXLimiter) acquire(ctx context.Context, proxyURL, host string) (func(), error) {
+	if l.max <= 0 {
+		return func() {}, nil
+	}
+	key := proxyMXKey{proxyURL, host}
+	l.mu.Lock()
+	pair, ok := l.pairs[key]
+	if !ok {
+		pair = &proxyMXPair{slots: make(chan struct{}, l.max)}
+		l.pairs[key] = pair
+	}
+	pair.users++
+	l.mu.Unlock()
+
+	leave := func() {
+		l.mu.Lock()
+		if pair.users--; pair.users == 0 {
+			delete(l.pairs, key)
+		}
+		l.mu.Unlock()
+	}
+	select {
+	case pair.slots <- struct{}{}:
+	default:
+		debugf(ctx, "%s: PROXY_MX_MAX_CONCURRENCY reached, waiting for a connection slot", host)
+		select {
+		case pair.slots <- struct{}{}:
+		case <-ctx.Done():
+			leave()
+			return nil, ctx.Err()
+		}
+	}
+	return func() {
+		<-pair.slots
+		leave()
+	}, nil
+}
+
+// releasingConn releases its slot of proxyMXSlots once closed.
+type releasingConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *releasingConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
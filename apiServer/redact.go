@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"regexp"
+)
+
+// LOG_REDACT_EMAILS masks the local part of every email address written to
+// the log, keeping the domain for debugging: john@example.com is logged as
+// j***@example.com.
+var LOG_REDACT_EMAILS bool
+
+// emailPattern matches anything that looks like an email address in a log
+// line, including addresses quoted in SMTP replies.
+var emailPattern = regexp.MustCompile(`([^\s<>"'@:;,()\[\]/]+)@([A-Za-z0-9\p{L}.\-]+)`)
+
+// redactEmails masks the local parts of the email addresses in s.
+func redactEmails(s []byte) []byte {
+	return emailPattern.ReplaceAllFunc(s, func(match []byte) []byte {
+		m := emailPattern.FindSubmatch(match)
+		local, domain := m[1], m[2]
+		redacted := append([]byte{}, local[0])
+		redacted = append(redacted, "***@"...)
+		return append(redacted, domain...)
+	})
+}
+
+// redactingWriter redacts the email addresses in each log line before
+// writing it out. The log package calls Write once per line.
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(redactEmails(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
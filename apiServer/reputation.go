@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+var (
+	// DOMAIN_REPUTATION_TTL is how long a domain found to be catch-all or
+	// repeatedly timing out skips the SMTP check. Every address at a
+	// catch-all domain gets the same answer, so the domain's classification
+	// is shared instead of probing and caching each address. Zero disables
+	// skipping.
+	DOMAIN_REPUTATION_TTL time.Duration
+	// DOMAIN_TIMEOUT_THRESHOLD is the number of consecutive SMTP timeouts
+	// after which a domain is skipped.
+	DOMAIN_TIMEOUT_THRESHOLD = 3
+)
+
+// domains remembers the SMTP behaviour of recently probed domains.
+var domains = &domainReputations{entries: map[string]*domainReputation{}}
+
+type domainReputation struct {
+	catchAll  bool
+	timeouts  int // consecutive SMTP timeouts
+	updatedAt time.Time
+}
+
+type domainReputations struct {
+	mu      sync.Mutex
+	entries map[string]*domainReputation
+}
+
+// skipReason returns the note explaining why the SMTP check of domain can
+// be skipped, or "" when it has to run. With perAddress, only timing out
+// domains are skipped.
+func (d *domainReputations) skipReason(domain string, perAddress bool) string {
+	if DOMAIN_REPUTATION_TTL <= 0 {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rep, ok := d.entries[domain]
+	if !ok || time.Since(rep.updatedAt) > DOMAIN_REPUTATION_TTL {
+		return ""
+	}
+	switch {
+	case rep.catchAll && !perAddress:
+		return noteSkippedCatchAllDomain
+	case rep.timeouts >= DOMAIN_TIMEOUT_THRESHOLD:
+		return noteSkippedTimeoutDomain
+	}
+	return ""
+}
+
+// catchAll returns whether domain was found to be catch-all, and false for
+// known when it wasn't probed within DOMAIN_REPUTATION_TTL.
+func (d *domainReputations) catchAll(domain string) (catchAll, known bool) {
+	if DOMAIN_REPUTATION_TTL <= 0 {
+		return false, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rep, ok := d.entries[domain]
+	if !ok || time.Since(rep.updatedAt) > DOMAIN_REPUTATION_TTL || rep.timeouts > 0 {
+		return false, false
+	}
+	return rep.catchAll, true
+}
+
+// record updates the reputation of domain with the outcome of an SMTP
+// check.
+func (d *domainReputations) record(domain string, smtp *emailVerifier.SMTP, err error) {
+	if DOMAIN_REPUTATION_TTL <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rep, ok := d.entries[domain]
+	if !ok || time.Since(rep.updatedAt) > DOMAIN_REPUTATION_TTL {
+		rep = &domainReputation{}
+		d.entries[domain] = rep
+	}
+	rep.updatedAt = time.Now()
+
+	var lookupErr *emailVerifier.LookupError
+	switch {
+	case errors.As(err, &lookupErr) && lookupErr.Message == emailVerifier.ErrTimeout:
+		rep.timeouts++
+	case err == nil:
+		rep.timeouts = 0
+		rep.catchAll = smtp.HostExists && smtp.CatchAll
+	}
+}
+
+// sweep periodically forgets expired reputations.
+func (d *domainReputations) sweep() {
+	for range time.Tick(time.Minute) {
+		d.mu.Lock()
+		for domain, rep := range d.entries {
+			if time.Since(rep.updatedAt) > DOMAIN_REPUTATION_TTL {
+				delete(d.entries, domain)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// skippedSMTP returns the classification used in place of an SMTP check
+// skipped for reason.
+func skippedSMTP(reason string) (*emailVerifier.SMTP, error) {
+	if reason == noteSkippedTimeoutDomain {
+		return nil, &emailVerifier.LookupError{
+			Message: emailVerifier.ErrTimeout,
+			Details: "SMTP check skipped, the domain's mail servers timed out repeatedly",
+		}
+	}
+	return &emailVerifier.SMTP{HostExists: true, CatchAll: true}, nil
+}
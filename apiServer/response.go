@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+	"golang.org/x/net/idna"
+)
+
+// schemaVersion is reported in every VerificationResponse so clients can
+// tell which shape they are reading. Bump it whenever fields are added,
+// removed or change meaning, and record the change below.
+//
+//	1: the library Result only
+//	2: local_part, domain, domain_ascii, verified_at, age_seconds,
+//	   deliverable and normalized_email; schema_version itself
+//	3: notes
+//	4: syntax_error
+//	5: passive
+//	6: smtp_host
+//	7: confidence
+//	8: forced_mx_host
+//	9: input
+//	10: suggestion_result
+//	11: timings
+//	12: email_nfc
+//	13: custom_classification
+//	14: mx_ttl
+//	15: raw
+//	16: homograph_suspect
+//	17: domain_age_days and young_domain
+//	18: base_email
+//	19: reasons
+const schemaVersion = 19
+
+// VerificationResponse is the verification result returned to clients. It
+// embeds the library Result so its fields stay at the top level, and adds
+// the fields computed by this service.
+type VerificationResponse struct {
+	SchemaVersion int `json:"schema_version"`
+	*emailVerifier.Result
+	LocalPart   string  `json:"local_part,omitempty"`
+	Domain      string  `json:"domain,omitempty"`
+	DomainASCII string  `json:"domain_ascii,omitempty"` // punycode form, only set for IDN domains
+	VerifiedAt  string  `json:"verified_at"`
+	AgeSeconds  *int64  `json:"age_seconds,omitempty"` // only set for cached results
+	Deliverable bool    `json:"deliverable"`           // verdict of the deliverability policy
+	Confidence  float64 `json:"confidence"`            // likelihood of deliverability, see confidence
+
+	NormalizedEmail string   `json:"normalized_email,omitempty"` // when requested or with NORMALIZE_LOCAL_PART
+	Notes           []string `json:"notes,omitempty"`            // checks that were skipped or degraded
+	SyntaxError     string   `json:"syntax_error,omitempty"`     // why the syntax was found invalid
+	// Passive is set when the mail servers weren't contacted, so
+	// deliverability was inferred rather than confirmed over SMTP
+	Passive bool `json:"passive,omitempty"`
+	// SMTPHost is the MX host that answered the SMTP check
+	SMTPHost string `json:"smtp_host,omitempty"`
+	// ForcedMXHost is set when the SMTP check went to the mx_host given in
+	// the request instead of the domain's MX hosts
+	ForcedMXHost bool `json:"forced_mx_host,omitempty"`
+	// Input is the address as given when it had a display name, the
+	// extracted address being in email
+	Input string `json:"input,omitempty"`
+	// SuggestionResult is the verification of the suggested correction,
+	// with ?verify_suggestion=true
+	SuggestionResult *VerificationResponse `json:"suggestion_result,omitempty"`
+	// Timings are the milliseconds spent per phase, with ?timings=true.
+	// Cached results have none.
+	Timings map[string]int64 `json:"timings,omitempty"`
+	// EmailNFC is the NFC form of email with NORMALIZE_UNICODE, when it
+	// differs from the address as given
+	EmailNFC string `json:"email_nfc,omitempty"`
+	// CustomClassification is the label of the first CLASSIFICATION_RULES
+	// rule the response matches
+	CustomClassification string `json:"custom_classification,omitempty"`
+	// MXTTL is how many seconds the MX records are still valid for, when
+	// the DNS answer carried their TTL
+	MXTTL *int64 `json:"mx_ttl,omitempty"`
+	// Raw is the library Result alone, with ?raw=true. It shares the
+	// embedded Result rather than copying it.
+	Raw *emailVerifier.Result `json:"raw,omitempty"`
+	// HomographSuspect is set with HOMOGRAPH_CHECK, true when the domain
+	// may imitate another with lookalike characters
+	HomographSuspect *bool `json:"homograph_suspect,omitempty"`
+	// DomainAgeDays is the age of the registrable domain with
+	// ?domain_age=true, when its registry reports it. YoungDomain is set
+	// with it, true under YOUNG_DOMAIN_DAYS.
+	DomainAgeDays *int  `json:"domain_age_days,omitempty"`
+	YoungDomain   *bool `json:"young_domain,omitempty"`
+	// BaseEmail is the address without its tag, for providers with a
+	// subaddress separator, see subaddressSeparators
+	BaseEmail string `json:"base_email,omitempty"`
+	// Reasons are the checks of the deliverability policy the address
+	// fails, so deliverable is false exactly when there are some
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// RESULT_STATUS_MODE selects the HTTP status of completed verifications.
+//
+//   - "http" (the default) answers 422 for addresses with an invalid
+//     syntax, and 200 for the others.
+//   - "always200" answers 200 whatever the verdict, which is then only in
+//     the body, for clients that treat any other status as a failure.
+//
+// Verifications that couldn't complete keep their error status either way.
+var RESULT_STATUS_MODE = "http"
+
+// parseResultStatusMode validates a RESULT_STATUS_MODE value.
+func parseResultStatusMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return "http", nil
+	case "http", "always200":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid RESULT_STATUS_MODE %q, must be http or always200", mode)
+	}
+}
+
+// resultStatus is the HTTP status of a completed verification of ret, see
+// RESULT_STATUS_MODE.
+func resultStatus(ret *emailVerifier.Result) int {
+	if RESULT_STATUS_MODE == "http" && !ret.Syntax.Valid {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusOK
+}
+
+// responseOptions are the per-request settings that shape a
+// VerificationResponse.
+type responseOptions struct {
+	policy    deliverabilityPolicy
+	normalize bool
+	input     string // the email as given in the request, see addressFromInput
+	// verifySuggestion also verifies the suggested correction, see
+	// suggestionResult
+	verifySuggestion bool
+	timings          bool // include the phase timings
+	raw              bool // include the library Result under "raw"
+	domainAge        bool // look up the age of the domain, see domainAges
+}
+
+func responseOptionsFromRequest(r *http.Request) responseOptions {
+	return responseOptions{
+		policy:           policyFromRequest(r),
+		verifySuggestion: r.URL.Query().Get("verify_suggestion") == "true",
+		timings:          r.URL.Query().Get("timings") == "true",
+		raw:              r.URL.Query().Get("raw") == "true",
+		domainAge:        r.URL.Query().Get("domain_age") == "true",
+	}
+}
+
+// newVerificationResponse wraps the library Result of v, splitting the
+// validated address into its local part and domain. The domain age lookup
+// stops when ctx ends or what is left of the EMAIL_TOTAL_BUDGET runs out.
+func newVerificationResponse(ctx context.Context, v *Verification, opts responseOptions) *VerificationResponse {
+	ret := v.Result
+	resp := &VerificationResponse{
+		SchemaVersion: schemaVersion,
+		Result:        ret,
+		VerifiedAt:    v.VerifiedAt.UTC().Format(time.RFC3339),
+		Reasons:       opts.policy.reasons(ret),
+		Confidence:    confidence(ret),
+		Notes:         v.Notes,
+		SyntaxError:   v.SyntaxError,
+		Passive:       slices.Contains(v.Notes, noteSkippedPassive),
+		ForcedMXHost:  slices.Contains(v.Notes, noteForcedMXHost),
+	}
+	resp.Deliverable = len(resp.Reasons) == 0
+	if opts.input != ret.Email {
+		resp.Input = opts.input
+	}
+	if opts.raw {
+		resp.Raw = ret
+	}
+	if v.MXTTL >= 0 {
+		// Counted down for the time the verification was cached
+		ttl := int64(max(0, v.MXTTL-time.Since(v.VerifiedAt)).Seconds())
+		resp.MXTTL = &ttl
+	}
+	if NORMALIZE_UNICODE && nfc(ret.Email) != ret.Email {
+		resp.EmailNFC = nfc(ret.Email)
+	}
+	if v.SMTPReply != nil {
+		resp.SMTPHost = v.SMTPReply.Host
+	}
+	if v.Cached {
+		age := int64(time.Since(v.VerifiedAt).Seconds())
+		resp.AgeSeconds = &age
+	} else if opts.timings {
+		resp.Timings = v.Timings
+	}
+	if ret.Syntax.Valid {
+		resp.LocalPart = ret.Syntax.Username
+		resp.Domain, resp.DomainASCII = domainForms(ret.Syntax.Domain)
+		resp.BaseEmail = baseEmail(ret.Syntax.Username, resp.Domain)
+		if HOMOGRAPH_CHECK {
+			suspect := homographSuspect(resp.Domain)
+			resp.HomographSuspect = &suspect
+		}
+		if opts.domainAge {
+			ctx, cancel := budgetContext(ctx, v)
+			if registered, ok := domainAges.registered(ctx, domainToASCII(resp.Domain)); ok {
+				days := int(time.Since(registered).Hours() / 24)
+				young := days < YOUNG_DOMAIN_DAYS
+				resp.DomainAgeDays, resp.YoungDomain = &days, &young
+			}
+			cancel()
+		}
+		if opts.normalize || NORMALIZE_LOCAL_PART {
+			resp.NormalizedEmail = normalizeEmail(ret.Syntax.Username, resp.Domain)
+		}
+	}
+	resp.CustomClassification = classify(classificationRules, resp)
+	return resp
+}
+
+// domainForms returns the Unicode form of domain and, when it differs, its
+// punycode form. Domains that fail IDNA conversion are returned unchanged.
+func domainForms(domain string) (unicode, ascii string) {
+	unicode = domain
+	if u, err := idna.ToUnicode(domain); err == nil {
+		unicode = u
+	}
+	if a, err := idna.ToASCII(domain); err == nil && a != unicode {
+		ascii = a
+	}
+	return unicode, ascii
+}
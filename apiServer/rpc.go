@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000 // the verification itself failed
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"` // nil for notifications
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func rpcFailure(id json.RawMessage, code int, message string) *rpcResponse {
+	return &rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: code, Message: message}, ID: id}
+}
+
+// RPC serves JSON-RPC 2.0 calls, single or batched. The "verify" method
+// takes the same params as the body of POST /v1/verify and returns the same
+// result. A batch counts against the bulk email limit of the token, and
+// its calls share BULK_CONCURRENCY and MAX_QUEUE_WAIT with the bulk
+// requests. Responses are never wrapped with RESPONSE_ENVELOPE.
+func RPC(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		writeJSON(w, r, http.StatusOK, rpcFailure(nil, rpcParseError, "Invalid request body"))
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if !bytes.HasPrefix(body, []byte("[")) {
+		if resp := callRPC(r, sharedVerifier(), body, nil); resp != nil {
+			writeJSON(w, r, http.StatusOK, resp)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeJSON(w, r, http.StatusOK, rpcFailure(nil, rpcParseError, "Parse error"))
+		return
+	}
+	if len(batch) == 0 {
+		writeJSON(w, r, http.StatusOK, rpcFailure(nil, rpcInvalidRequest, "Empty batch"))
+		return
+	}
+	if maxEmails := tokenConfigFrom(r.Context()).maxEmails(); len(batch) > maxEmails {
+		writeJSON(w, r, http.StatusOK, rpcFailure(nil, rpcInvalidRequest, fmt.Sprintf("Too many calls in batch (max %d)", maxEmails)))
+		return
+	}
+
+	ctx, cancel := bulkContext(r.Context())
+	defer cancel()
+	grace := cancelGrace(ctx)
+	r = r.WithContext(ctx)
+
+	// The calls of a batch wait for bulkSlots like the emails of a bulk
+	// request, and the ones still running once ctx is done get its
+	// cancelGrace before they are answered with an error
+	verifier := sharedVerifier()
+	tenant := &bulkTenant{}
+	var mu sync.Mutex
+	responses := make([]*rpcResponse, len(batch))
+	done := make([]bool, len(batch))
+	var wg sync.WaitGroup
+	for i, call := range batch {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := callRPC(r, verifier, call, tenant)
+			mu.Lock()
+			responses[i], done[i] = resp, true
+			mu.Unlock()
+		}()
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		select {
+		case <-finished:
+		case <-time.After(grace):
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, call := range batch {
+		if !done[i] {
+			var unfinished rpcRequest
+			if json.Unmarshal(call, &unfinished) == nil && unfinished.ID != nil {
+				responses[i] = rpcFailure(unfinished.ID, rpcServerError, rpcIncomplete)
+			}
+		}
+	}
+
+	// Notifications get no response, and neither does a batch of them
+	answered := responses[:0]
+	for _, resp := range responses {
+		if resp != nil {
+			answered = append(answered, resp)
+		}
+	}
+	if len(answered) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, answered)
+}
+
+// rpcIncomplete is the error message of the calls of a batch that didn't
+// complete before its deadline.
+const rpcIncomplete = "Verification didn't complete in time"
+
+// callRPC runs a single call and returns its response, or nil when the
+// call is a notification. Calls of a batch hold a slot of bulkSlots for
+// tenant while verifying, single calls pass a nil tenant and don't wait.
+func callRPC(r *http.Request, verifier *Verifier, raw json.RawMessage, tenant *bulkTenant) *rpcResponse {
+	if !json.Valid(raw) {
+		return rpcFailure(nil, rpcParseError, "Parse error")
+	}
+	var call rpcRequest
+	if err := json.Unmarshal(raw, &call); err != nil || call.JSONRPC != "2.0" || call.Method == "" {
+		return rpcFailure(call.ID, rpcInvalidRequest, "Invalid request")
+	}
+
+	resp := handleRPC(r, verifier, &call, tenant)
+	if call.ID == nil {
+		return nil
+	}
+	return resp
+}
+
+func handleRPC(r *http.Request, verifier *Verifier, call *rpcRequest, tenant *bulkTenant) *rpcResponse {
+	if call.Method != "verify" {
+		return rpcFailure(call.ID, rpcMethodNotFound, fmt.Sprintf("Method %q not found", call.Method))
+	}
+
+	var req VerificationRequest
+	if err := json.Unmarshal(call.Params, &req); err != nil {
+		return rpcFailure(call.ID, rpcInvalidParams, "params must be an object with an email")
+	}
+	if req.Email == "" {
+		return rpcFailure(call.ID, rpcInvalidParams, "email is required")
+	}
+	email, err := addressFromInput(req.Email)
+	if err != nil {
+		return rpcFailure(call.ID, rpcInvalidParams, err.Error())
+	}
+	opts, respOpts, err := req.options(r)
+	if err != nil {
+		return rpcFailure(call.ID, rpcInvalidParams, err.Error())
+	}
+
+	if tenant != nil {
+		opts.Bulk = true
+		if err := bulkSlots.acquire(r.Context(), tenant, MAX_QUEUE_WAIT); errors.Is(err, errQueueTimeout) {
+			return rpcFailure(call.ID, rpcServerError, "Server busy, timed out waiting for a verification slot")
+		} else if err != nil {
+			return rpcFailure(call.ID, rpcServerError, rpcIncomplete)
+		}
+		defer bulkSlots.release()
+	}
+	verification, err := verifier.Verify(r.Context(), email, opts)
+	if err != nil {
+		return rpcFailure(call.ID, rpcServerError, err.Error())
+	}
+	resp := newVerificationResponse(r.Context(), verification, respOpts)
+	if respOpts.verifySuggestion {
+		resp.SuggestionResult = verifier.suggestionResult(r.Context(), verification, opts, respOpts)
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: resp, ID: call.ID}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRPCBatchHoldsBulkSlots(t *testing.T) {
+	t.Setenv("FROM_EMAIL", "probe@example.com")
+	t.Setenv("HELO_NAME", "example.com")
+	var running, peak atomic.Int32
+	stubVerifier(t, func(ctx context.Context, email string, opts verifyOptions) (*Verification, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		return deliverableVerification(ctx, email, opts)
+	})
+	defer func(slots *fairScheduler) { bulkSlots = slots }(bulkSlots)
+	bulkSlots = newFairScheduler(1)
+
+	var calls []string
+	for i := range 4 {
+		calls = append(calls, fmt.Sprintf(`{"jsonrpc": "2.0", "method": "verify", "params": {"email": "user%d@example.com"}, "id": %d}`, i, i))
+	}
+	w := httptest.NewRecorder()
+	RPC(w, httptest.NewRequest(http.MethodPost, "/v1/rpc", strings.NewReader("["+strings.Join(calls, ",")+"]")), nil)
+
+	var responses []rpcResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if len(responses) != len(calls) {
+		t.Fatalf("got %d responses, want %d: %s", len(responses), len(calls), w.Body)
+	}
+	for _, resp := range responses {
+		if resp.Error != nil {
+			t.Errorf("call %s failed: %s", resp.ID, resp.Error.Message)
+		}
+	}
+	if got := peak.Load(); got != 1 {
+		t.Errorf("%d calls verified at once, want BULK_CONCURRENCY's 1", got)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+// classificationRules label verification responses with the first rule of
+// CLASSIFICATION_RULES they match, reported as custom_classification. No
+// rules are applied by default.
+var classificationRules []classificationRule
+
+// classificationRule labels the responses matching all of its conditions. A
+// rule without conditions matches every response, as a fallback at the end.
+type classificationRule struct {
+	Label string `json:"label"`
+	// When maps response fields, as named in ruleFields, to the value they
+	// must have
+	When map[string]any `json:"when"`
+}
+
+// ruleFields are the response fields rules can test, by their JSON name.
+var ruleFields = map[string]func(*VerificationResponse) any{
+	"reachable":      func(r *VerificationResponse) any { return r.Reachable },
+	"deliverable":    func(r *VerificationResponse) any { return r.Deliverable },
+	"free":           func(r *VerificationResponse) any { return r.Free },
+	"disposable":     func(r *VerificationResponse) any { return r.Disposable },
+	"role_account":   func(r *VerificationResponse) any { return r.RoleAccount },
+	"has_mx_records": func(r *VerificationResponse) any { return r.HasMxRecords },
+	"syntax_valid":   func(r *VerificationResponse) any { return r.Syntax.Valid },
+	"passive":        func(r *VerificationResponse) any { return r.Passive },
+	"catch_all":      func(r *VerificationResponse) any { return r.SMTP != nil && r.SMTP.CatchAll },
+	"full_inbox":     func(r *VerificationResponse) any { return r.SMTP != nil && r.SMTP.FullInbox },
+	"disabled":       func(r *VerificationResponse) any { return r.SMTP != nil && r.SMTP.Disabled },
+	"domain":         func(r *VerificationResponse) any { return r.Domain },
+}
+
+// loadClassificationRules parses CLASSIFICATION_RULES, which holds either a
+// JSON array of rules or the path of a file containing one. Rules are tried
+// in order, for example:
+//
+//	[{"label": "consumer", "when": {"free": true, "disposable": false}},
+//	 {"label": "business", "when": {"free": false, "deliverable": true}},
+//	 {"label": "other"}]
+func loadClassificationRules(config string) ([]classificationRule, error) {
+	if config == "" {
+		return nil, nil
+	}
+
+	data := []byte(config)
+	if !strings.HasPrefix(strings.TrimSpace(config), "[") {
+		var err error
+		if data, err = os.ReadFile(config); err != nil {
+			return nil, fmt.Errorf("reading CLASSIFICATION_RULES: %w", err)
+		}
+	}
+	var rules []classificationRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing CLASSIFICATION_RULES: %w", err)
+	}
+
+	// Check the expected values against the fields' types, so a typo such
+	// as "true" for true doesn't silently never match
+	sample := &VerificationResponse{Result: &emailVerifier.Result{}}
+	for i, rule := range rules {
+		if rule.Label == "" {
+			return nil, fmt.Errorf("CLASSIFICATION_RULES: rule %d has no label", i+1)
+		}
+		for name, want := range rule.When {
+			field, ok := ruleFields[name]
+			if !ok {
+				return nil, fmt.Errorf("CLASSIFICATION_RULES: rule %q tests unknown field %q", rule.Label, name)
+			}
+			if reflect.TypeOf(want) != reflect.TypeOf(field(sample)) {
+				return nil, fmt.Errorf("CLASSIFICATION_RULES: rule %q expects %T for field %q", rule.Label, field(sample), name)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// classify returns the label of the first rule resp matches, or an empty
+// string when none does.
+func classify(rules []classificationRule, resp *VerificationResponse) string {
+	for _, rule := range rules {
+		if rule.matches(resp) {
+			return rule.Label
+		}
+	}
+	return ""
+}
+
+func (rule classificationRule) matches(resp *VerificationResponse) bool {
+	for name, want := range rule.When {
+		if ruleFields[name](resp) != want {
+			return false
+		}
+	}
+	return true
+}
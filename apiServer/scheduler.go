@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BULK_CONCURRENCY caps the verifications in flight across all bulk
+// requests and jobs. Slots are handed to the waiting requests in turn, so a
+// large list can't starve the ones submitted after it. Zero leaves each
+// bulk request with its own workers and no shared cap.
+var BULK_CONCURRENCY = 0
+
+// MAX_QUEUE_WAIT is how long a bulk request waits for a slot before it is
+// answered 503. Zero waits as long as the request lasts. Jobs always wait.
+var MAX_QUEUE_WAIT time.Duration
+
+// errQueueTimeout is returned by acquire once MAX_QUEUE_WAIT has passed.
+var errQueueTimeout = errors.New("timed out waiting for a verification slot")
+
+// bulkSlots is nil while BULK_CONCURRENCY is zero.
+var bulkSlots *fairScheduler
+
+// JOB_CONCURRENCY caps the verifications in flight across all jobs, within
+// BULK_CONCURRENCY when both are set. Keeping it below BULK_CONCURRENCY
+// leaves slots to the interactive bulk requests however many jobs run,
+// and the single verifications never wait for a slot. Zero leaves jobs
+// with no cap of their own.
+var JOB_CONCURRENCY = 0
+
+// jobSlots is nil while JOB_CONCURRENCY is zero.
+var jobSlots *fairScheduler
+
+// fairScheduler is a semaphore that grants its slots round-robin across
+// tenants, the bulk verifications waiting for a slot, rather than in
+// arrival order.
+type fairScheduler struct {
+	mu      sync.Mutex
+	slots   int
+	free    int
+	waiting []*bulkTenant // tenants with waiters, next to be served first
+
+	queueTimeouts atomic.Int64 // acquisitions that gave up after maxWait
+}
+
+// bulkTenant queues the workers of one bulk verification.
+type bulkTenant struct {
+	waiters []chan struct{}
+}
+
+func newFairScheduler(slots int) *fairScheduler {
+	if slots <= 0 {
+		return nil
+	}
+	return &fairScheduler{slots: slots, free: slots}
+}
+
+// backlog returns the number of acquisitions waiting for a slot, and the
+// number of slots.
+func (s *fairScheduler) backlog() (waiting, slots int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.waiting {
+		waiting += len(t.waiters)
+	}
+	return waiting, s.slots
+}
+
+// acquire blocks until t is granted a slot. It returns the error of ctx
+// when it ends first, or errQueueTimeout after waiting for maxWait unless
+// maxWait is zero.
+func (s *fairScheduler) acquire(ctx context.Context, t *bulkTenant, maxWait time.Duration) error {
+	if s == nil {
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	if s.free > 0 {
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	granted := make(chan struct{}, 1)
+	t.waiters = append(t.waiters, granted)
+	if len(t.waiters) == 1 {
+		s.waiting = append(s.waiting, t)
+	}
+	s.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case <-granted:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = errQueueTimeout
+		s.queueTimeouts.Add(1)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, waiter := range t.waiters {
+		if waiter == granted {
+			t.waiters = append(t.waiters[:i], t.waiters[i+1:]...)
+			if len(t.waiters) == 0 {
+				s.removeTenant(t)
+			}
+			return err
+		}
+	}
+	// Granted while giving up, pass the slot on
+	s.handOver()
+	return err
+}
+
+// release returns a slot, handing it to the next tenant in turn.
+func (s *fairScheduler) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handOver()
+}
+
+// handOver gives a slot to the first waiting tenant, which then goes to the
+// back of the line, or frees it when nobody waits. Callers hold s.mu.
+func (s *fairScheduler) handOver() {
+	if len(s.waiting) == 0 {
+		s.free++
+		return
+	}
+	t := s.waiting[0]
+	s.waiting = s.waiting[1:]
+	t.waiters[0] <- struct{}{}
+	t.waiters = t.waiters[1:]
+	if len(t.waiters) > 0 {
+		s.waiting = append(s.waiting, t)
+	}
+}
+
+func (s *fairScheduler) removeTenant(t *bulkTenant) {
+	for i, waiting := range s.waiting {
+		if waiting == t {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return
+		}
+	}
+}
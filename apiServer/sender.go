@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateSender checks per-request overrides of the probe's MAIL FROM
+// address and EHLO name against the ALLOWED_FROM_EMAILS and
+// ALLOWED_HELO_NAMES allowlists, so the service can't be used to probe as
+// arbitrary senders. An ALLOWED_FROM_EMAILS entry is either a full address
+// or "@domain", allowing any address at that domain. Overrides are rejected
+// while the lists are empty; empty values mean no override and are always
+// accepted.
+func validateSender(fromEmail, heloName string) error {
+	settings := runtimeSettings()
+	if fromEmail != "" && !senderAllowed(settings.AllowedFromEmails, fromEmail) {
+		return fmt.Errorf("from_email %q is not allowed", fromEmail)
+	}
+	if heloName != "" && !containsFold(settings.AllowedHeloNames, heloName) {
+		return fmt.Errorf("helo_name %q is not allowed", heloName)
+	}
+	return nil
+}
+
+func senderAllowed(allowed []string, fromEmail string) bool {
+	if containsFold(allowed, fromEmail) {
+		return true
+	}
+	at := strings.LastIndex(fromEmail, "@")
+	return at >= 0 && containsFold(allowed, fromEmail[at:])
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+package main
+
+import "net/http"
+
+var (
+	// MAX_HEADER_BYTES caps the size of request headers, larger requests
+	// are answered 431. Raise it behind proxies or gateways that add large
+	// headers, such as long tracing or identity tokens, whose requests
+	// would otherwise be refused before reaching any handler.
+	MAX_HEADER_BYTES = http.DefaultMaxHeaderBytes
+	// HTTP_KEEP_ALIVES keeps client connections open between requests.
+	// Turn it off when a load balancer spreads connections rather than
+	// requests, so long-lived connections don't pin clients to one
+	// instance, or when many short-lived clients leave idle connections
+	// holding file descriptors. Every request then pays for a new
+	// connection, and a TLS handshake with TLS_CERT_FILE.
+	HTTP_KEEP_ALIVES = true
+)
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// settings is the configuration that can be changed without a restart, by
+// editing the environment file and sending SIGHUP. Secrets and the listen
+// address are only read at startup.
+type settings struct {
+	MaxEmails         int
+	JobMaxEmails      int
+	DebugSampleRate   float64
+	AllowedFromEmails []string
+	AllowedHeloNames  []string
+	// DisposableDomains are treated as disposable on top of the library's
+	// list.
+	DisposableDomains map[string]bool
+	// MaxDisposableEmails bounds POST /v1/bulk/disposable, which is cheap
+	// enough for much larger lists than the other bulk endpoints.
+	MaxDisposableEmails int
+	// MaintenanceMode rejects verification requests, see withMaintenance.
+	MaintenanceMode       bool
+	MaintenanceRetryAfter time.Duration
+}
+
+var currentSettings atomic.Pointer[settings]
+
+func init() {
+	currentSettings.Store(loadSettings())
+}
+
+// runtimeSettings returns the settings in effect. The returned value is
+// shared and must not be modified; a reload replaces it as a whole.
+func runtimeSettings() *settings {
+	return currentSettings.Load()
+}
+
+// loadSettings reads the reloadable settings from the environment.
+func loadSettings() *settings {
+	s := &settings{
+		MaxEmails:         envInt("MAX_EMAILS", 15),
+		JobMaxEmails:      envInt("JOB_MAX_EMAILS", 10000),
+		DebugSampleRate:   min(max(envFloat("DEBUG_SAMPLE_RATE", 0), 0), 1),
+		AllowedFromEmails: envList("ALLOWED_FROM_EMAILS"),
+		AllowedHeloNames:  envList("ALLOWED_HELO_NAMES"),
+		DisposableDomains: map[string]bool{},
+
+		MaxDisposableEmails: envInt("MAX_DISPOSABLE_EMAILS", 10000),
+
+		MaintenanceMode:       envBool("MAINTENANCE_MODE", false),
+		MaintenanceRetryAfter: envDuration("MAINTENANCE_RETRY_AFTER", 5*time.Minute),
+	}
+	for _, domain := range envList("DISPOSABLE_DOMAINS") {
+		s.DisposableDomains[strings.ToLower(domain)] = true
+	}
+	return s
+}
+
+// describe renders the settings by environment variable, for logging
+// what a reload changed.
+func (s *settings) describe() map[string]string {
+	disposable := make([]string, 0, len(s.DisposableDomains))
+	for domain := range s.DisposableDomains {
+		disposable = append(disposable, domain)
+	}
+	sort.Strings(disposable)
+
+	return map[string]string{
+		"MAX_EMAILS":          fmt.Sprint(s.MaxEmails),
+		"JOB_MAX_EMAILS":      fmt.Sprint(s.JobMaxEmails),
+		"DEBUG_SAMPLE_RATE":   fmt.Sprint(s.DebugSampleRate),
+		"ALLOWED_FROM_EMAILS": strings.Join(s.AllowedFromEmails, ","),
+		"ALLOWED_HELO_NAMES":  strings.Join(s.AllowedHeloNames, ","),
+		"DISPOSABLE_DOMAINS":  strings.Join(disposable, ","),
+
+		"MAX_DISPOSABLE_EMAILS": fmt.Sprint(s.MaxDisposableEmails),
+
+		"MAINTENANCE_MODE":        fmt.Sprint(s.MaintenanceMode),
+		"MAINTENANCE_RETRY_AFTER": s.MaintenanceRetryAfter.String(),
+	}
+}
+
+// reloadOnSIGHUP re-reads the environment file and applies the reloadable
+// settings whenever the process receives SIGHUP. Variables removed from the
+// file keep their previous value. /etc/resolv.conf is re-read as well.
+func reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := reloadEnvFile(); err != nil {
+			log.Println("SIGHUP: no .env file reloaded:", err)
+		}
+		loadResolvConf()
+
+		previous := runtimeSettings().describe()
+		next := loadSettings()
+		currentSettings.Store(next)
+
+		changed := false
+		for key, value := range next.describe() {
+			if previous[key] != value {
+				log.Printf("SIGHUP: %s changed from %q to %q", key, previous[key], value)
+				changed = true
+			}
+		}
+		if !changed {
+			log.Println("SIGHUP: configuration reloaded, nothing changed")
+		}
+	}
+}
+
+// reloadEnvFile sets the variables of the reloadable settings from the
+// environment file. The others, AUTH_TOKEN among them, keep the value they
+// had at startup even when the file changes them.
+func reloadEnvFile() error {
+	env, err := godotenv.Read()
+	if err != nil {
+		return err
+	}
+	for key := range runtimeSettings().describe() {
+		if value, ok := env[key]; ok {
+			os.Setenv(key, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadEnvFileKeepsSecrets(t *testing.T) {
+	t.Setenv("AUTH_TOKEN", "startup-token")
+	t.Setenv("MAX_EMAILS", "15")
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, ".env"), []byte("AUTH_TOKEN=rotated-token\nMAX_EMAILS=7\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(dir)
+
+	if err := reloadEnvFile(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("AUTH_TOKEN"); got != "startup-token" {
+		t.Errorf("AUTH_TOKEN = %q after reloading, want the startup one", got)
+	}
+	if got := os.Getenv("MAX_EMAILS"); got != "7" {
+		t.Errorf("MAX_EMAILS = %q after reloading, want 7", got)
+	}
+}
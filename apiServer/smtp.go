@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/proxy"
+)
+
+const smtpPort = "25"
+
+// smtpProbe checks mailbox deliverability over SMTP. It runs the same dialog
+// as the library's CheckSMTP, but keeps the server replies the library
+// discards.
+type smtpProbe struct {
+	fromEmail        string     // address used in MAIL FROM, empty for the null sender
+	heloNames        []string   // names tried in EHLO in order, until a server accepts one
+	proxies          *proxyPool // proxies for the SMTP connections
+	network          string     // "tcp", "tcp4" or "tcp6", see ipNetwork
+	connectTimeout   time.Duration
+	operationTimeout time.Duration
+	commandDelay     time.Duration // pause between commands, counted against operationTimeout
+	mxTryLimit       int           // MX hosts dialed per check, all of them when zero
+	startTLS         bool          // upgrade with STARTTLS when the server offers it
+	tlsInsecure      bool          // skip certificate verification on STARTTLS
+	mxHost           string        // dialed instead of the domain's MX hosts when set
+	publicOnly       bool          // refuse direct connections to non-routable addresses
+	jitterMax        time.Duration // random wait before connecting, see SMTP_JITTER_MAX
+	deadline         time.Time     // the dialog doesn't outlast it when set, see EMAIL_TOTAL_BUDGET
+}
+
+// smtpReply is a reply received from the mail server.
+type smtpReply struct {
+	Code    int
+	Message string
+	Host    string // MX host of the server, set once connected
+}
+
+// check probes username@domain. Like the library it first sends RCPT TO for
+// a random address to detect catch-all servers, and only probes the real
+// address when the random one is rejected. The returned reply is the last
+// one the server sent, normally its answer to RCPT TO for the address. Once
+// connected a reply is always returned, if only to report the MX host. A
+// server rejecting the EHLO name is reconnected to with the next of
+// heloNames.
+//
+// Waiting for the jitter, for proxy and MX slots and between commands stops
+// once ctx is done. The exchanges with the server, once the slots are held,
+// run to completion instead, bounded by exchangeTimeout and deadline, so a
+// verification in flight when its request ends still gets an answer.
+func (p *smtpProbe) check(ctx context.Context, domain, username string) (*emailVerifier.SMTP, *smtpReply, error) {
+	var ret emailVerifier.SMTP
+
+	if err := p.jitter(ctx); err != nil {
+		return &ret, nil, err
+	}
+	proxyURL, release, err := p.proxies.acquire(ctx)
+	if err != nil {
+		return &ret, nil, err
+	}
+	defer release()
+	if proxyURL != "" {
+		debugf(ctx, "%s: dialing through proxy %s", domain, redactURL(proxyURL))
+	}
+	exchange, cancel := p.exchangeContext(ctx)
+	defer cancel()
+
+	var client *smtp.Client
+	var host string
+	withHost := func(reply *smtpReply) *smtpReply {
+		if reply == nil {
+			reply = &smtpReply{}
+		}
+		reply.Host = host
+		return reply
+	}
+
+	// A rejected greeting can't be retried on the same connection, so each
+	// name is tried on a new one
+	for i, name := range p.heloNames {
+		var err error
+		if client, host, err = p.dial(ctx, exchange, domain, proxyURL); err != nil {
+			return &ret, replyFromError(err), smtpError(err)
+		}
+		debugf(ctx, "%s: connected to %s", domain, host)
+		if err = client.Hello(name); err == nil {
+			debugf(ctx, "%s: %s accepted EHLO %s", domain, host, name)
+			break
+		}
+		client.Close()
+		var protoErr *textproto.Error
+		if !errors.As(err, &protoErr) || i == len(p.heloNames)-1 {
+			return &ret, withHost(replyFromError(err)), smtpError(err)
+		}
+		debugf(ctx, "%s: %s rejected EHLO %s with %d %s", domain, host, name, protoErr.Code, protoErr.Msg)
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok && p.startTLS {
+		// Only the mailbox's existence is checked, no message is sent, so
+		// an unverified certificate exposes little
+		config := &tls.Config{ServerName: host, InsecureSkipVerify: p.tlsInsecure}
+		if err = client.StartTLS(config); err != nil {
+			return &ret, withHost(replyFromError(err)), smtpError(err)
+		}
+	}
+	if err = p.pause(ctx); err != nil {
+		return &ret, withHost(nil), err
+	}
+	if err = client.Mail(p.fromEmail); err != nil {
+		return &ret, withHost(replyFromError(err)), smtpError(err)
+	}
+
+	// Host exists if we've successfully formed a connection
+	ret.HostExists = true
+
+	// Assume catch-all until a random address is rejected
+	ret.CatchAll = true
+	if err = p.pause(ctx); err != nil {
+		return &ret, withHost(nil), err
+	}
+	reply, err := rcpt(client, emailVerifier.GenerateRandomEmail(domain))
+	if reply != nil {
+		debugf(ctx, "%s: catch-all probe got %d %s", domain, reply.Code, reply.Message)
+	}
+	if err != nil {
+		if e := emailVerifier.ParseSMTPError(err); e != nil {
+			switch e.Message {
+			case emailVerifier.ErrFullInbox:
+				ret.FullInbox = true
+			case emailVerifier.ErrNotAllowed:
+				ret.Disabled = true
+			case emailVerifier.ErrServerUnavailable:
+				// Usually a 550 5.1.1, meaning the random recipient doesn't exist
+				ret.CatchAll = false
+			}
+		}
+	}
+	if ret.CatchAll || username == "" {
+		return &ret, withHost(reply), nil
+	}
+
+	if err = p.pause(ctx); err != nil {
+		return &ret, withHost(reply), err
+	}
+	reply, err = rcpt(client, username+"@"+domain)
+	if reply != nil {
+		debugf(ctx, "%s: RCPT TO got %d %s", domain, reply.Code, reply.Message)
+	}
+	if err == nil {
+		ret.Deliverable = true
+	}
+	return &ret, withHost(reply), nil
+}
+
+// pause waits for commandDelay before the next command is sent, or until
+// ctx is done.
+func (p *smtpProbe) pause(ctx context.Context) error {
+	if p.commandDelay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(p.commandDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jitter waits for a random duration up to jitterMax, or until ctx is done.
+func (p *smtpProbe) jitter(ctx context.Context) error {
+	if p.jitterMax <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(rand.N(p.jitterMax))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// exchangeContext returns the context of the SMTP dialog of a check waiting
+// on ctx: detached from its cancellation, and ending after exchangeTimeout
+// or at deadline, whichever comes first.
+func (p *smtpProbe) exchangeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(p.exchangeTimeout())
+	if !p.deadline.IsZero() && p.deadline.Before(deadline) {
+		deadline = p.deadline
+	}
+	return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+}
+
+// exchangeTimeout bounds the SMTP dialog of a check: connecting and talking
+// to each of the mxTryLimit hosts it may dial.
+func (p *smtpProbe) exchangeTimeout() time.Duration {
+	return (p.connectTimeout + p.operationTimeout) * time.Duration(max(p.mxTryLimit, 1))
+}
+
+// dial connects to the MX hosts of domain concurrently and returns the first
+// client that completes the connection, with the MX host it reached. Only
+// the mxTryLimit most preferred hosts are dialed. Lookups and slot waits
+// stop once ctx is done, while the connection is made on exchange and
+// doesn't outlive its deadline.
+func (p *smtpProbe) dial(ctx, exchange context.Context, domain, proxyURL string) (*smtp.Client, string, error) {
+	if p.mxHost != "" {
+		client, err := p.dialHost(ctx, exchange, p.mxHost, proxyURL)
+		return client, p.mxHost, err
+	}
+
+	mxRecords, _, err := resolver.lookupMX(ctx, domainToASCII(domain))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(mxRecords) == 0 {
+		return nil, "", errors.New("No MX records found")
+	}
+	// The records are sorted by preference
+	if p.mxTryLimit > 0 && len(mxRecords) > p.mxTryLimit {
+		mxRecords = mxRecords[:p.mxTryLimit]
+	}
+
+	type dialResult struct {
+		client *smtp.Client
+		host   string
+		err    error
+	}
+	// Dials that lose the race stop waiting for their PROXY_MX_MAX_CONCURRENCY slot
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(mxRecords))
+	for _, mx := range mxRecords {
+		go func(host string) {
+			client, err := p.dialHost(ctx, exchange, host, proxyURL)
+			results <- dialResult{client, strings.TrimSuffix(host, "."), err}
+		}(mx.Host)
+	}
+
+	var firstErr error
+	for i := range mxRecords {
+		res := <-results
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+
+		// Close the connections that lost the race
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if late := <-results; late.client != nil {
+					late.client.Close()
+				}
+			}
+		}(len(mxRecords) - i - 1)
+		return res.client, res.host, nil
+	}
+	return nil, "", firstErr
+}
+
+// dialHost opens an SMTP connection to host on exchange, through proxyURL
+// unless it is empty. The connection holds a slot of proxyMXSlots, waited
+// for until ctx is done, until it is closed.
+func (p *smtpProbe) dialHost(ctx, exchange context.Context, host, proxyURL string) (*smtp.Client, error) {
+	host = strings.TrimSuffix(host, ".")
+	release, err := proxyMXSlots.acquire(ctx, proxyURL, strings.ToLower(host))
+	if err != nil {
+		return nil, err
+	}
+	dialed, err := p.dialConn(exchange, host, smtpPort, proxyURL)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	conn := &releasingConn{Conn: dialed, release: release}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// dialConn connects to port of host, through proxyURL unless it is empty,
+// with a deadline of operationTimeout that doesn't outlive ctx.
+func (p *smtpProbe) dialConn(ctx context.Context, host, port, proxyURL string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxyURL != "" {
+		conn, err = p.dialProxy(ctx, host, port, proxyURL)
+	} else {
+		dialer := net.Dialer{Timeout: p.connectTimeout}
+		if p.publicOnly {
+			dialer.Control = refuseNonRoutable
+		}
+		conn, err = dialer.DialContext(ctx, p.network, net.JoinHostPort(host, port))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(p.operationTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialProxy connects to port of host through proxyURL. With no address
+// family preference the proxy resolves host itself; otherwise host is
+// resolved here to an address of the preferred family, which the proxy must
+// then be able to reach.
+func (p *smtpProbe) dialProxy(ctx context.Context, host, port, proxyURL string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.connectTimeout)
+	defer cancel()
+
+	if p.network != "tcp" {
+		family := "ip4"
+		if p.network == "tcp6" {
+			family = "ip6"
+		}
+		ips, err := net.DefaultResolver.LookupIP(ctx, family, host)
+		if err != nil {
+			return nil, err
+		}
+		host = ips[0].String()
+	}
+	addr := net.JoinHostPort(host, port)
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("proxy scheme %q does not support dial timeouts", u.Scheme)
+	}
+	conn, err := contextDialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, proxyError(proxyURL, err)
+	}
+	return conn, nil
+}
+
+// ipNetwork maps an IPV6_PREFERENCE value to the network used to dial MX
+// hosts. "auto" considers both A and AAAA records and lets the dialer race
+// the two families, "ipv4" and "ipv6" restrict dialing to one family.
+// Behind a proxy the connection is made by the proxy, so "ipv6" only works
+// when the proxy itself has IPv6 egress.
+func ipNetwork(preference string) (string, error) {
+	switch preference {
+	case "", "auto":
+		return "tcp", nil
+	case "ipv4":
+		return "tcp4", nil
+	case "ipv6":
+		return "tcp6", nil
+	default:
+		return "", fmt.Errorf("invalid IPV6_PREFERENCE %q, must be auto, ipv4 or ipv6", preference)
+	}
+}
+
+// rcpt sends RCPT TO for addr. Unlike smtp.Client.Rcpt it returns the
+// server's reply whether or not the recipient was accepted.
+func rcpt(client *smtp.Client, addr string) (*smtpReply, error) {
+	if strings.ContainsAny(addr, "\r\n") {
+		return nil, errors.New("smtp: A line must not contain CR or LF")
+	}
+	id, err := client.Text.Cmd("RCPT TO:<%s>", addr)
+	if err != nil {
+		return nil, err
+	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+
+	code, msg, err := client.Text.ReadResponse(25)
+	if code == 0 {
+		return nil, err
+	}
+	return &smtpReply{Code: code, Message: msg}, err
+}
+
+// replyFromError extracts the server reply from an error returned by
+// net/smtp, or returns nil when the error didn't come from the server.
+func replyFromError(err error) *smtpReply {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return &smtpReply{Code: protoErr.Code, Message: protoErr.Msg}
+	}
+	return nil
+}
+
+// smtpError classifies err the way the library does, unless it is already
+// classified. It avoids returning a typed nil when ParseSMTPError has
+// nothing to report.
+func smtpError(err error) error {
+	var lookupErr *emailVerifier.LookupError
+	if errors.As(err, &lookupErr) {
+		return err
+	}
+	if e := emailVerifier.ParseSMTPError(err); e != nil {
+		return e
+	}
+	return err
+}
+
+// redactURL strips the credentials from a URL so it can be logged.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	return u.Redacted()
+}
+
+// domainToASCII converts an IDN domain to punycode, returning it unchanged
+// if the conversion fails.
+func domainToASCII(domain string) string {
+	ascii, err := idna.ToASCII(domain)
+	if err != nil {
+		return domain
+	}
+	return ascii
+}
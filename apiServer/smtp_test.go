@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckStopsWaitingForSlots(t *testing.T) {
+	pool := newProxyPool([]string{"socks5://a:1080"}, 1)
+	_, release, err := pool.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// No budget, only the request's cancellation ends the wait
+	probe := &smtpProbe{proxies: pool, jitterMax: time.Hour, connectTimeout: time.Second, operationTimeout: time.Second}
+	for _, jitter := range []bool{true, false} {
+		if !jitter {
+			probe.jitterMax = 0
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		if _, _, err := probe.check(ctx, "example.com", "john"); !errors.Is(err, context.Canceled) {
+			t.Errorf("jitter %t: check returned %v, want the cancellation", jitter, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("jitter %t: check gave up after %s, want the cancellation", jitter, elapsed)
+		}
+	}
+}
+
+func TestExchangeContext(t *testing.T) {
+	probe := &smtpProbe{connectTimeout: time.Second, operationTimeout: 2 * time.Second, mxTryLimit: 3}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	exchange, cancelExchange := probe.exchangeContext(ctx)
+	defer cancelExchange()
+	if exchange.Err() != nil {
+		t.Error("the exchange ended with the cancelled request")
+	}
+	if deadline, ok := exchange.Deadline(); !ok || time.Until(deadline) > 9*time.Second || time.Until(deadline) < 8*time.Second {
+		t.Errorf("exchange deadline in %s, want the 9s of exchangeTimeout", time.Until(deadline))
+	}
+
+	// A budget ending sooner bounds it instead
+	probe.deadline = time.Now().Add(time.Second)
+	exchange, cancelExchange = probe.exchangeContext(ctx)
+	defer cancelExchange()
+	if deadline, _ := exchange.Deadline(); !deadline.Equal(probe.deadline) {
+		t.Errorf("exchange deadline %s, want the budget's %s", deadline, probe.deadline)
+	}
+}
+
+func TestPauseStopsWithContext(t *testing.T) {
+	probe := &smtpProbe{commandDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := probe.pause(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("pause returned %v, want the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("pause gave up after %s, want the context's deadline", elapsed)
+	}
+	probe.commandDelay = 0
+	if err := probe.pause(ctx); err != nil {
+		t.Errorf("pause without a delay returned %v", err)
+	}
+}
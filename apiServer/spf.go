@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// spfLookupLimit is the number of DNS lookups an SPF evaluation may cause,
+// as in RFC 7208.
+const spfLookupLimit = 10
+
+// errNoSPF is returned for domains without an SPF record.
+var errNoSPF = errors.New("no SPF record")
+
+// checkSenderSPF warns when the SPF record of FROM_EMAIL's domain doesn't
+// authorize the addresses of the proxies. Servers that check the sender of
+// the probes see the proxies' addresses, and some of them reject or tarpit
+// senders failing SPF. The proxy hosts are resolved here, so a proxy
+// egressing from another address than its own is reported wrongly. It only
+// logs, and isn't run for direct connections or the null sender since then
+// there is nothing to compare.
+func checkSenderSPF(fromEmail string, proxyURLs []string) {
+	at := strings.LastIndex(fromEmail, "@")
+	if at < 0 || len(proxyURLs) == 0 {
+		return
+	}
+	domain := strings.ToLower(fromEmail[at+1:])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, proxyURL := range proxyURLs {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", u.Hostname())
+		if err != nil {
+			log.Printf("SPF check of %s: resolving proxy %s failed: %v", domain, redactURL(proxyURL), err)
+			continue
+		}
+		for _, ip := range ips {
+			pass, err := (&spfChecker{}).authorizes(ctx, domain, ip)
+			switch {
+			case errors.Is(err, errNoSPF):
+				log.Printf("WARNING: %s has no SPF record, probes sent as FROM_EMAIL may be rejected by servers checking it", domain)
+				return
+			case err != nil:
+				log.Printf("SPF check of %s failed: %v", domain, err)
+				return
+			case !pass:
+				log.Printf("WARNING: SPF of %s doesn't authorize %s of proxy %s, probes sent as FROM_EMAIL may be rejected by servers checking it", domain, ip, redactURL(proxyURL))
+			}
+		}
+	}
+}
+
+// spfChecker evaluates SPF records, counting the DNS lookups across
+// includes and redirects. Macros and the exists and ptr mechanisms aren't
+// supported, they never match.
+type spfChecker struct {
+	lookups int
+}
+
+// authorizes reports whether the SPF record of domain passes ip.
+func (c *spfChecker) authorizes(ctx context.Context, domain string, ip net.IP) (bool, error) {
+	record, err := lookupSPF(ctx, domain)
+	if err != nil {
+		return false, err
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		term = strings.ToLower(term)
+		if name, value, ok := strings.Cut(term, "="); ok {
+			if name == "redirect" {
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := byte('+')
+		if strings.IndexByte("+-~?", term[0]) >= 0 {
+			qualifier, term = term[0], term[1:]
+		}
+		matched, err := c.matches(ctx, domain, term, ip)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return qualifier == '+', nil
+		}
+	}
+
+	if redirect == "" {
+		return false, nil
+	}
+	if err := c.lookup(); err != nil {
+		return false, err
+	}
+	return c.authorizes(ctx, redirect, ip)
+}
+
+// matches reports whether the mechanism of domain's record matches ip.
+func (c *spfChecker) matches(ctx context.Context, domain, mechanism string, ip net.IP) (bool, error) {
+	name, arg, _ := strings.Cut(mechanism, ":")
+	if strings.Contains(arg, "%") {
+		return false, nil
+	}
+	// a and mx take an optional domain and prefix lengths, as in a:host/24//64
+	if prefix := strings.IndexByte(name, '/'); prefix >= 0 {
+		name, arg = name[:prefix], name[prefix:]
+	}
+	target, prefixes, _ := strings.Cut(arg, "/")
+	if target == "" {
+		target = domain
+	}
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			return net.ParseIP(arg).Equal(ip), nil
+		}
+		_, network, err := net.ParseCIDR(arg)
+		return err == nil && network.Contains(ip), nil
+	case "include":
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+		pass, err := c.authorizes(ctx, arg, ip)
+		if errors.Is(err, errNoSPF) {
+			return false, fmt.Errorf("included domain %s has no SPF record", arg)
+		}
+		return pass, err
+	case "a", "mx":
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			mxRecords, err := net.DefaultResolver.LookupMX(ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, err
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxRecords {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+			if err != nil && !isNotFound(err) {
+				return false, err
+			}
+			for _, candidate := range ips {
+				if spfPrefixMatch(candidate, ip, prefixes) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	default:
+		return false, nil
+	}
+}
+
+// lookup counts a DNS lookup against spfLookupLimit.
+func (c *spfChecker) lookup() error {
+	if c.lookups++; c.lookups > spfLookupLimit {
+		return fmt.Errorf("more than %d DNS lookups", spfLookupLimit)
+	}
+	return nil
+}
+
+// lookupSPF returns the SPF record of domain.
+func lookupSPF(ctx context.Context, domain string) (string, error) {
+	records, err := net.DefaultResolver.LookupTXT(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return "", err
+	}
+	for _, record := range records {
+		if fields := strings.Fields(record); len(fields) > 0 && strings.EqualFold(fields[0], "v=spf1") {
+			return record, nil
+		}
+	}
+	return "", errNoSPF
+}
+
+// spfPrefixMatch reports whether ip is in the network of candidate with the
+// prefix lengths of an a or mx mechanism, "24", "/64" or "24//64", the
+// whole address when a length is missing.
+func spfPrefixMatch(candidate, ip net.IP, prefixes string) bool {
+	v4, v6, _ := strings.Cut("/"+prefixes, "//")
+	bits, size := strings.TrimPrefix(v4, "/"), 32
+	if candidate.To4() == nil {
+		bits, size = v6, 128
+	} else {
+		candidate = candidate.To4()
+	}
+	ones, err := strconv.Atoi(bits)
+	if err != nil || ones < 0 || ones > size {
+		ones = size
+	}
+	network := net.IPNet{IP: candidate.Mask(net.CIDRMask(ones, size)), Mask: net.CIDRMask(ones, size)}
+	return network.Contains(ip)
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,22 @@
+-- Table written by the result store when DATABASE_URL is set. Apply it
+-- once before starting the server:
+--
+--   psql "$DATABASE_URL" -f apiServer/sql/verifications.sql
+
+CREATE TABLE IF NOT EXISTS verifications (
+    id             BIGSERIAL PRIMARY KEY,
+    email_hash     TEXT        NOT NULL, -- SHA-256 of the lowercased address
+    domain         TEXT        NOT NULL,
+    classification TEXT        NOT NULL, -- valid, invalid, unknown or failed
+    reachable      TEXT        NOT NULL,
+    deliverable    BOOLEAN     NOT NULL, -- verdict of the strict policy
+    cached         BOOLEAN     NOT NULL,
+    token          TEXT        NOT NULL, -- fingerprint of the API token
+    error          TEXT,
+    verified_at    TIMESTAMPTZ NOT NULL,
+    recorded_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS verifications_email_hash_idx ON verifications (email_hash);
+CREATE INDEX IF NOT EXISTS verifications_domain_idx ON verifications (domain);
+CREATE INDEX IF NOT EXISTS verifications_verified_at_idx ON verifications (verified_at);
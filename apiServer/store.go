@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+var (
+	// DATABASE_URL is the PostgreSQL database every verification is
+	// recorded in, see sql/verifications.sql for its table. Nothing is
+	// recorded while it is empty.
+	DATABASE_URL string
+	// STORE_BUFFER is how many verifications wait to be written. Once it is
+	// full, further ones are dropped until the database catches up.
+	STORE_BUFFER = 10000
+	// STORE_BATCH_SIZE and STORE_FLUSH_INTERVAL bound each insert: rows are
+	// written once STORE_BATCH_SIZE of them are waiting, or every
+	// STORE_FLUSH_INTERVAL.
+	STORE_BATCH_SIZE     = 500
+	STORE_FLUSH_INTERVAL = time.Second
+)
+
+// store records the verifications, it is nil when DATABASE_URL is empty.
+var store *resultStore
+
+// storeColumns are the columns written per row. PostgreSQL accepts 65535
+// parameters per statement, which caps STORE_BATCH_SIZE.
+const storeColumns = 10
+
+// storedVerification is a row of the verifications table.
+type storedVerification struct {
+	emailHash      string
+	domain         string
+	classification string
+	reachable      string
+	deliverable    bool
+	cached         bool
+	token          string
+	err            string
+	verifiedAt     time.Time
+}
+
+// resultStore writes verifications to PostgreSQL in batches from a
+// buffer, so requests never wait for the database. Rows that can't be
+// written are logged and dropped.
+type resultStore struct {
+	db      *sql.DB
+	rows    chan storedVerification
+	dropped atomic.Int64 // rows dropped since the last report
+}
+
+// openResultStore connects to the database at url and starts the writer.
+// The database may still be unavailable, writes are retried with each
+// batch.
+func openResultStore(url string) (*resultStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DATABASE_URL: %w", err)
+	}
+	s := &resultStore{db: db, rows: make(chan storedVerification, STORE_BUFFER)}
+	go s.write()
+	return s, nil
+}
+
+// recordVerification queues the outcome of verifying email for the
+// database, when one is configured.
+func recordVerification(ctx context.Context, email string, v *Verification, err error) {
+	if store == nil {
+		return
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(email)))
+	row := storedVerification{
+		emailHash:      hex.EncodeToString(sum[:]),
+		classification: "failed",
+		token:          tokenConfigFrom(ctx).id,
+		verifiedAt:     time.Now(),
+	}
+	if _, domain, ok := strings.Cut(email, "@"); ok {
+		row.domain = strings.ToLower(domain)
+	}
+	if v != nil {
+		row.reachable = v.Result.Reachable
+		row.cached = v.Cached
+		row.verifiedAt = v.VerifiedAt
+		if err == nil {
+			row.classification = outcomeClass(v.Result)
+			row.deliverable = strictPolicy().deliverable(v.Result)
+		}
+	}
+	if err != nil {
+		row.err = err.Error()
+	}
+
+	select {
+	case store.rows <- row:
+	default:
+		store.dropped.Add(1)
+	}
+}
+
+// write inserts the queued rows in batches until the process exits.
+func (s *resultStore) write() {
+	ticker := time.NewTicker(STORE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	size := min(max(STORE_BATCH_SIZE, 1), 65535/storeColumns)
+	batch := make([]storedVerification, 0, size)
+	for {
+		select {
+		case row := <-s.rows:
+			batch = append(batch, row)
+			if len(batch) < size {
+				continue
+			}
+		case <-ticker.C:
+			if dropped := s.dropped.Swap(0); dropped > 0 {
+				log.Printf("Result store buffer full, %d verifications dropped", dropped)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := s.insert(batch); err != nil {
+			log.Printf("Writing %d verifications to the database failed: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+// insert writes rows with a single statement.
+func (s *resultStore) insert(rows []storedVerification) error {
+	var query strings.Builder
+	query.WriteString("INSERT INTO verifications (email_hash, domain, classification, reachable, deliverable, cached, token, error, verified_at, recorded_at) VALUES ")
+	args := make([]interface{}, 0, len(rows)*storeColumns)
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(")
+		for c := 1; c <= storeColumns; c++ {
+			if c > 1 {
+				query.WriteString(", ")
+			}
+			fmt.Fprintf(&query, "$%d", i*storeColumns+c)
+		}
+		query.WriteString(")")
+		var errMsg sql.NullString
+		if row.err != "" {
+			errMsg = sql.NullString{String: row.err, Valid: true}
+		}
+		args = append(args, row.emailHash, row.domain, row.classification, row.reachable,
+			row.deliverable, row.cached, row.token, errMsg, row.verifiedAt, time.Now())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, query.String(), args...)
+	return err
+}
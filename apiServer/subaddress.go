@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// subaddressSeparators maps provider domains to the character that starts
+// a tag in their local parts, so john+news@gmail.com is delivered to
+// john@gmail.com. Addresses at these domains report their untagged form as
+// base_email. SUBADDRESS_SEPARATORS adds providers or overrides these.
+var subaddressSeparators = map[string]string{
+	"gmail.com":      "+",
+	"googlemail.com": "+",
+	"outlook.com":    "+",
+	"hotmail.com":    "+",
+	"live.com":       "+",
+	"icloud.com":     "+",
+	"me.com":         "+",
+	"fastmail.com":   "+",
+	"proton.me":      "+",
+	"protonmail.com": "+",
+	"yahoo.com":      "-",
+}
+
+// loadSubaddressSeparators merges SUBADDRESS_SEPARATORS into the default
+// table. It holds either a JSON object mapping domains to their separator
+// or the path of a file containing one, for example:
+//
+//	{"example.org": "+", "mail.example.net": "-"}
+//
+// An empty separator removes a default provider.
+func loadSubaddressSeparators(config string) (map[string]string, error) {
+	separators := map[string]string{}
+	for domain, sep := range subaddressSeparators {
+		separators[domain] = sep
+	}
+	if config == "" {
+		return separators, nil
+	}
+
+	data := []byte(config)
+	if !strings.HasPrefix(strings.TrimSpace(config), "{") {
+		var err error
+		if data, err = os.ReadFile(config); err != nil {
+			return nil, fmt.Errorf("reading SUBADDRESS_SEPARATORS: %w", err)
+		}
+	}
+	var loaded map[string]string
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("parsing SUBADDRESS_SEPARATORS: %w", err)
+	}
+	for domain, sep := range loaded {
+		domain = strings.ToLower(domain)
+		if sep == "" {
+			delete(separators, domain)
+			continue
+		}
+		if len([]rune(sep)) != 1 || sep == "@" {
+			return nil, fmt.Errorf("SUBADDRESS_SEPARATORS: invalid separator %q for %s", sep, domain)
+		}
+		separators[domain] = sep
+	}
+	return separators, nil
+}
+
+// baseEmail returns the address without the tag of its local part when
+// domain has a subaddress separator and the local part is tagged, and an
+// empty string otherwise.
+func baseEmail(localPart, domain string) string {
+	domain = strings.ToLower(domain)
+	sep, ok := subaddressSeparators[domain]
+	if !ok {
+		return ""
+	}
+	base, _, tagged := strings.Cut(localPart, sep)
+	if !tagged || base == "" {
+		return ""
+	}
+	return base + "@" + domain
+}
@@ -0,0 +1,26 @@
+package main
+
+import "context"
+
+// suggestionResult verifies the address with the domain suggested for
+// verification, for ?verify_suggestion=true, so a form can tell whether the
+// correction it offers is deliverable. It returns nil when there is no
+// suggestion or its verification failed. The extra verification goes
+// through the same cache, proxy pool and circuit breaker as the first one.
+func (v *Verifier) suggestionResult(ctx context.Context, verification *Verification, opts verifyOptions, respOpts responseOptions) *VerificationResponse {
+	ret := verification.Result
+	if ret.Suggestion == "" || !ret.Syntax.Valid {
+		return nil
+	}
+
+	corrected := ret.Syntax.Username + "@" + ret.Suggestion
+	opts.Suggest = false
+	opts.MXHost = "" // forced for the original domain only
+	suggested, err := v.Verify(ctx, corrected, opts)
+	if err != nil {
+		debugf(ctx, "%s: verifying suggestion %s failed: %v", ret.Email, corrected, err)
+		return nil
+	}
+	respOpts.input = corrected
+	return newVerificationResponse(ctx, suggested, respOpts)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// SYNTAX_MODE selects how addresses are checked before any network work.
+//
+//   - "lenient" (the default) relies on the library's syntax check, with
+//     quoted local parts also checked by quotedLocalPartError since the
+//     library accepts unescaped quotes and backslashes inside them. It
+//     accepts addresses of any length.
+//   - "strict" additionally rejects addresses whose dot-atom local part has
+//     a leading, trailing or doubled dot, whose quoted local part holds an
+//     unescaped quote or backslash, or that exceed the RFC 5321 limits: 64
+//     octets for the local part, 253 for the domain, 63 per domain label
+//     and 254 overall. Non-ASCII characters stay allowed as in RFC 6531.
+var SYNTAX_MODE = "lenient"
+
+// CHECK_TLD rejects addresses whose top-level domain isn't in the public
+// suffix list, such as user@example.invalid, before any network check.
+var CHECK_TLD = true
+
+// syntaxErrorInvalidTLD is reported for domains failing CHECK_TLD.
+const syntaxErrorInvalidTLD = "invalid_tld"
+
+// syntaxErrorTrailingDots is reported for domains ending in more than one
+// dot, see trimTrailingDot.
+const syntaxErrorTrailingDots = "trailing_dots"
+
+// parseSyntaxMode validates a SYNTAX_MODE value.
+func parseSyntaxMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return "lenient", nil
+	case "lenient", "strict":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid SYNTAX_MODE %q, must be lenient or strict", mode)
+	}
+}
+
+// strictSyntaxError returns why email breaks the strict syntax rules, or ""
+// when it follows them. The address is split at its last "@", since a
+// quoted local part may itself contain one.
+func strictSyntaxError(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "missing_at_sign"
+	}
+	local, domain := email[:at], email[at+1:]
+
+	switch {
+	case len(email) > 254:
+		return "address_too_long"
+	case len(local) == 0:
+		return "empty_local_part"
+	case len(local) > 64:
+		return "local_part_too_long"
+	}
+
+	var reason string
+	if strings.HasPrefix(local, `"`) {
+		reason = quotedLocalPartError(local)
+	} else {
+		reason = dotAtomError(local)
+	}
+	if reason != "" {
+		return reason
+	}
+	return domainError(domain)
+}
+
+// dotAtomError checks an unquoted local part.
+func dotAtomError(local string) string {
+	switch {
+	case strings.HasPrefix(local, "."), strings.HasSuffix(local, "."):
+		return "leading_or_trailing_dot"
+	case strings.Contains(local, ".."):
+		return "consecutive_dots"
+	}
+	for _, c := range local {
+		if c < 0x80 && !isAtext(byte(c)) && c != '.' {
+			return "invalid_local_part_character"
+		}
+	}
+	return ""
+}
+
+// quotedLocalPartError checks a local part in quotes. Inside the quotes any
+// printable character or space is allowed, including "@" and consecutive
+// dots, except that quotes and backslashes must be escaped with a
+// backslash, as in "john\"doe"@example.com.
+func quotedLocalPartError(local string) string {
+	if len(local) < 2 || !strings.HasSuffix(local, `"`) {
+		return "unterminated_quoted_local_part"
+	}
+	inner := local[1 : len(local)-1]
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		switch {
+		case c == '\\':
+			if i++; i == len(inner) || (inner[i] < 0x20 && inner[i] != '\t') || inner[i] == 0x7f {
+				return "invalid_quoted_pair"
+			}
+		case c == '"':
+			return "unescaped_quote"
+		case (c < 0x20 && c != '\t') || c == 0x7f:
+			return "invalid_quoted_character"
+		}
+	}
+	return ""
+}
+
+// domainError checks the length limits of a domain in its ASCII form.
+func domainError(domain string) string {
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "invalid_domain"
+	}
+	if len(ascii) > 253 {
+		return "domain_too_long"
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if len(label) > 63 {
+			return "domain_label_too_long"
+		}
+	}
+	return ""
+}
+
+// isAtext reports whether c is an ASCII character allowed in a dot-atom
+// (RFC 5322 atext).
+func isAtext(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+// knownTLD reports whether the top-level domain of domain is delegated by
+// ICANN according to the public suffix list.
+func knownTLD(domain string) bool {
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return false
+	}
+	tld := ascii[strings.LastIndex(ascii, ".")+1:]
+	_, icann := publicsuffix.PublicSuffix(tld)
+	return icann
+}
+
+// trimTrailingDot returns email without the trailing dot of a fully
+// qualified domain, as in user@example.com., which resolves the same but
+// fails the syntax checks. Domains ending in several dots are returned
+// unchanged and rejected by verify.
+func trimTrailingDot(email string) string {
+	if strings.HasSuffix(email, ".") && !strings.HasSuffix(email, "..") && !strings.HasSuffix(email, "@.") {
+		return email[:len(email)-1]
+	}
+	return email
+}
+
+// addressFromInput returns the address to verify from a request's input,
+// which may be in the RFC 5322 name-addr form, as in
+// "John Doe <john@example.com>". Other inputs are returned unchanged and
+// left to the syntax checks, since net/mail is stricter than the lenient
+// mode.
+func addressFromInput(input string) (string, error) {
+	if !strings.ContainsAny(input, "<>") {
+		return input, nil
+	}
+	addr, err := mail.ParseAddress(input)
+	if err != nil {
+		return "", fmt.Errorf("malformed display name address: %s", strings.TrimPrefix(err.Error(), "mail: "))
+	}
+	return addr.Address, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+// syntaxVerdict runs the syntax checks of verify on email with SYNTAX_MODE
+// set to mode. It returns "" when they pass, and otherwise the syntax
+// error, "invalid" when the library rejects the address itself. Addresses
+// at .invalid stop at CHECK_TLD, right after the syntax checks, so no
+// network work is done.
+func syntaxVerdict(t *testing.T, mode, email string) string {
+	t.Helper()
+	defer func(mode string, checkTLD bool) { SYNTAX_MODE, CHECK_TLD = mode, checkTLD }(SYNTAX_MODE, CHECK_TLD)
+	SYNTAX_MODE, CHECK_TLD = mode, true
+
+	v := &Verifier{checks: emailVerifier.NewVerifier()}
+	verification, err := v.verify(context.Background(), email, verifyOptions{})
+	if err != nil {
+		t.Fatalf("verify(%q): %v", email, err)
+	}
+	switch {
+	case verification.SyntaxError == syntaxErrorInvalidTLD:
+		return ""
+	case verification.Result.Syntax.Valid:
+		t.Fatalf("verify(%q) passed the syntax checks but didn't stop at CHECK_TLD", email)
+	case verification.SyntaxError == "":
+		return "invalid"
+	}
+	return verification.SyntaxError
+}
+
+func TestQuotedLocalParts(t *testing.T) {
+	tests := []struct {
+		email   string
+		lenient string
+		strict  string
+	}{
+		{`"john doe"@example.invalid`, "", ""},
+		{`"john..doe"@example.invalid`, "", ""},
+		{`".john."@example.invalid`, "", ""},
+		{`"john\"doe"@example.invalid`, "", ""},
+		{`"john\\doe"@example.invalid`, "", ""},
+		{`"john\doe"@example.invalid`, "", ""},
+		{`"john"doe"@example.invalid`, "unescaped_quote", "unescaped_quote"},
+		{`"john\"@example.invalid`, "invalid_quoted_pair", "invalid_quoted_pair"},
+		{`"john@example.invalid`, "invalid", "invalid"},
+		{`john"@example.invalid`, "invalid", "invalid"},
+	}
+	for _, tt := range tests {
+		if got := syntaxVerdict(t, "lenient", tt.email); got != tt.lenient {
+			t.Errorf("lenient %s: got %q, want %q", tt.email, got, tt.lenient)
+		}
+		if got := syntaxVerdict(t, "strict", tt.email); got != tt.strict {
+			t.Errorf("strict %s: got %q, want %q", tt.email, got, tt.strict)
+		}
+	}
+}
+
+func TestQuotedLocalPartError(t *testing.T) {
+	tests := []struct {
+		local string
+		want  string
+	}{
+		{`"john doe"`, ""},
+		{`"a@b..c"`, ""},
+		{`"tab\	ok"`, ""},
+		{`"john\"doe"`, ""},
+		{`""`, ""},
+		{`"`, "unterminated_quoted_local_part"},
+		{`"john`, "unterminated_quoted_local_part"},
+		{`"john\"`, "invalid_quoted_pair"},
+		{`"john"doe"`, "unescaped_quote"},
+		{"\"john\x00doe\"", "invalid_quoted_character"},
+		{"\"john\\\x00doe\"", "invalid_quoted_pair"},
+	}
+	for _, tt := range tests {
+		if got := quotedLocalPartError(tt.local); got != tt.want {
+			t.Errorf("quotedLocalPartError(%s) = %q, want %q", tt.local, got, tt.want)
+		}
+	}
+}
+
+func TestSyntaxModes(t *testing.T) {
+	long := func(n int) string { return strings.Repeat("a", n) }
+	tests := []struct {
+		email   string
+		lenient string
+		strict  string
+	}{
+		{"john.doe@example.invalid", "", ""},
+		{"john+tag@example.invalid", "", ""},
+		{"jöhn@exämple.invalid", "", ""},
+		{".john@example.invalid", "invalid", "invalid"},
+		{"john.@example.invalid", "invalid", "invalid"},
+		{"john..doe@example.invalid", "invalid", "invalid"},
+		{long(64) + "@example.invalid", "", ""},
+		{long(65) + "@example.invalid", "", "local_part_too_long"},
+		{"john@" + long(63) + ".invalid", "", ""},
+		{"john@" + long(64) + ".invalid", "", "domain_label_too_long"},
+		{long(64) + "@" + strings.Repeat(long(60)+".", 3) + "invalid", "", "address_too_long"},
+		{"john", "invalid", "invalid"},
+		{"john@", "invalid", "invalid"},
+		{"@example.invalid", "invalid", "invalid"},
+		{"john doe@example.invalid", "invalid", "invalid"},
+	}
+	for _, tt := range tests {
+		if got := syntaxVerdict(t, "lenient", tt.email); got != tt.lenient {
+			t.Errorf("lenient %s: got %q, want %q", tt.email, got, tt.lenient)
+		}
+		if got := syntaxVerdict(t, "strict", tt.email); got != tt.strict {
+			t.Errorf("strict %s: got %q, want %q", tt.email, got, tt.strict)
+		}
+	}
+}
+
+// The library already rejects the dot-atoms strict mode checks for, so
+// they are only reached by calling strictSyntaxError directly.
+func TestStrictSyntaxError(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"john.doe@example.com", ""},
+		{`"john..doe"@example.com`, ""},
+		{"john", "missing_at_sign"},
+		{"@example.com", "empty_local_part"},
+		{".john@example.com", "leading_or_trailing_dot"},
+		{"john.@example.com", "leading_or_trailing_dot"},
+		{"john..doe@example.com", "consecutive_dots"},
+		{"john,doe@example.com", "invalid_local_part_character"},
+		{`"john"doe"@example.com`, "unescaped_quote"},
+		{"john@exa mple.com", "invalid_domain"},
+	}
+	for _, tt := range tests {
+		if got := strictSyntaxError(tt.email); got != tt.want {
+			t.Errorf("strictSyntaxError(%s) = %q, want %q", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestParseSyntaxMode(t *testing.T) {
+	for mode, want := range map[string]string{"": "lenient", "lenient": "lenient", "strict": "strict"} {
+		if got, err := parseSyntaxMode(mode); err != nil || got != want {
+			t.Errorf("parseSyntaxMode(%q) = %q, %v, want %q", mode, got, err, want)
+		}
+	}
+	if _, err := parseSyntaxMode("loose"); err == nil {
+		t.Error("parseSyntaxMode(loose) succeeded")
+	}
+}
+
+func TestTrimTrailingDot(t *testing.T) {
+	tests := map[string]string{
+		"john@example.com.":   "john@example.com",
+		"john@example.com":    "john@example.com",
+		"john@example.com..":  "john@example.com..",
+		"john@example.com...": "john@example.com...",
+		"john@.":              "john@.",
+		"":                    "",
+	}
+	for email, want := range tests {
+		if got := trimTrailingDot(email); got != want {
+			t.Errorf("trimTrailingDot(%q) = %q, want %q", email, got, want)
+		}
+	}
+
+	// What is left with several dots is rejected by verify
+	for _, email := range []string{"john@example.invalid..", "john@example.invalid..."} {
+		if got := syntaxVerdict(t, "lenient", email); got != syntaxErrorTrailingDots {
+			t.Errorf("%s: got %q, want %q", email, got, syntaxErrorTrailingDots)
+		}
+	}
+	if got := syntaxVerdict(t, "strict", trimTrailingDot("john@example.invalid.")); got != "" {
+		t.Errorf("john@example.invalid. once trimmed: got %q, want it accepted", got)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var (
+	// TLS_CERT_FILE and TLS_KEY_FILE serve HTTPS with the given certificate
+	// and key instead of plain HTTP. Both must be set.
+	TLS_CERT_FILE string
+	TLS_KEY_FILE  string
+	// TLS_MIN_VERSION is the oldest protocol version accepted when serving
+	// HTTPS, "1.2" or "1.3".
+	TLS_MIN_VERSION uint16 = tls.VersionTLS12
+	// TLS_CIPHER_SUITES restricts the cipher suites offered for TLS 1.2 to the
+	// named ones, using the names of crypto/tls such as
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Go orders the suites itself and
+	// the TLS 1.3 suites can't be configured. Empty keeps Go's defaults.
+	TLS_CIPHER_SUITES []uint16
+)
+
+// parseTLSVersion maps a TLS_MIN_VERSION value to its crypto/tls constant.
+// Versions before 1.2 are refused, they fail every compliance scan.
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid TLS_MIN_VERSION %q, must be 1.2 or 1.3", version)
+	}
+}
+
+// parseCipherSuites maps the TLS_CIPHER_SUITES names to their IDs. Insecure
+// suites are refused.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS_CIPHER_SUITES entry %q, not a secure cipher suite", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// serverTLSConfig is the TLS configuration of the HTTPS server.
+func serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:   TLS_MIN_VERSION,
+		CipherSuites: TLS_CIPHER_SUITES,
+	}
+}
+
+// tlsVersionName returns the TLS_MIN_VERSION form of version.
+func tlsVersionName(version uint16) string {
+	return strings.TrimPrefix(tls.VersionName(version), "TLS ")
+}
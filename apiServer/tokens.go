@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/time/rate"
+)
+
+// Checks a tokenConfig can allow
+const (
+	checkSMTP     = "smtp"
+	checkGravatar = "gravatar"
+	checkSuggest  = "suggest"
+)
+
+// tokenConfig is the configuration of an API token from TOKENS_CONFIG.
+// Zero values fall back to the global settings.
+type tokenConfig struct {
+	MaxEmails    int `json:"max_emails"`     // emails per bulk request
+	JobMaxEmails int `json:"job_max_emails"` // emails per job
+	// RateLimit is the number of requests allowed per minute, unlimited
+	// when zero.
+	RateLimit int `json:"rate_limit"`
+	// Checks are the optional checks the token may run, all of them when
+	// empty. Checks a token isn't allowed are skipped.
+	Checks []string `json:"checks"`
+
+	limiter *rate.Limiter
+	id      string // fingerprint of the token, see tokenFingerprint
+}
+
+// defaultTokenConfig applies to AUTH_TOKEN and tokens without an entry.
+var defaultTokenConfig = &tokenConfig{}
+
+// tokens maps each token in TOKENS_CONFIG to its configuration.
+var tokens = map[string]*tokenConfig{}
+
+// loadTokens parses TOKENS_CONFIG, which holds either a JSON object
+// mapping tokens to their configuration or the path of a file containing
+// one. For example:
+//
+//	{"free-tier-token": {"max_emails": 5, "job_max_emails": 500, "rate_limit": 30, "checks": ["smtp"]}}
+func loadTokens(config string) (map[string]*tokenConfig, error) {
+	loaded := map[string]*tokenConfig{}
+	if config == "" {
+		return loaded, nil
+	}
+
+	data := []byte(config)
+	if !strings.HasPrefix(strings.TrimSpace(config), "{") {
+		var err error
+		if data, err = os.ReadFile(config); err != nil {
+			return nil, fmt.Errorf("reading TOKENS_CONFIG: %w", err)
+		}
+	}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("parsing TOKENS_CONFIG: %w", err)
+	}
+
+	for token, tc := range loaded {
+		if tc == nil {
+			tc = &tokenConfig{}
+			loaded[token] = tc
+		}
+		tc.id = tokenFingerprint(token)
+		for _, check := range tc.Checks {
+			if check != checkSMTP && check != checkGravatar && check != checkSuggest {
+				return nil, fmt.Errorf("TOKENS_CONFIG: unknown check %q", check)
+			}
+		}
+		if tc.RateLimit > 0 {
+			tc.limiter = rate.NewLimiter(rate.Limit(tc.RateLimit)/60, tc.RateLimit)
+		}
+	}
+	return loaded, nil
+}
+
+// tokenFingerprint identifies token in logs and alerts without revealing
+// it.
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+// allow reports whether the token may make another request now.
+func (tc *tokenConfig) allow() bool {
+	return tc.limiter == nil || tc.limiter.Allow()
+}
+
+// maxEmails returns the bulk limit of the token.
+func (tc *tokenConfig) maxEmails() int {
+	if tc.MaxEmails > 0 {
+		return tc.MaxEmails
+	}
+	return runtimeSettings().MaxEmails
+}
+
+// jobMaxEmails returns the job limit of the token.
+func (tc *tokenConfig) jobMaxEmails() int {
+	if tc.JobMaxEmails > 0 {
+		return tc.JobMaxEmails
+	}
+	return runtimeSettings().JobMaxEmails
+}
+
+// restrict turns off the checks of opts the token isn't allowed to run.
+func (tc *tokenConfig) restrict(opts verifyOptions) verifyOptions {
+	if len(tc.Checks) == 0 {
+		return opts
+	}
+	opts.SMTP = opts.SMTP && slices.Contains(tc.Checks, checkSMTP)
+	opts.Gravatar = opts.Gravatar && slices.Contains(tc.Checks, checkGravatar)
+	opts.Suggest = opts.Suggest && slices.Contains(tc.Checks, checkSuggest)
+	return opts
+}
+
+// AuthCheckResponse describes the token that authorized the request.
+type AuthCheckResponse struct {
+	Authorized   bool     `json:"authorized"`
+	TokenID      string   `json:"token_id"`       // fingerprint of the token, as in abuse alerts
+	MaxEmails    int      `json:"max_emails"`     // emails per bulk request
+	JobMaxEmails int      `json:"job_max_emails"` // emails per job
+	RateLimit    int      `json:"rate_limit"`     // requests per minute, unlimited when zero
+	Checks       []string `json:"checks"`         // optional checks the token may run
+}
+
+// GetAuthCheck confirms that the request's token is valid, which
+// verifyToken has established by the time it runs, and returns its
+// configuration. The request counts towards the token's rate limit.
+func GetAuthCheck(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tc := tokenConfigFrom(r.Context())
+	checks := tc.Checks
+	if len(checks) == 0 {
+		checks = []string{checkSMTP, checkGravatar, checkSuggest}
+	}
+	respondWithJSON(w, r, http.StatusOK, AuthCheckResponse{
+		Authorized:   true,
+		TokenID:      tc.id,
+		MaxEmails:    tc.maxEmails(),
+		JobMaxEmails: tc.jobMaxEmails(),
+		RateLimit:    tc.RateLimit,
+		Checks:       checks,
+	})
+}
+
+type tokenConfigKey struct{}
+
+// withTokenConfig returns a copy of ctx carrying the configuration of the
+// token that authorized the request.
+func withTokenConfig(ctx context.Context, tc *tokenConfig) context.Context {
+	return context.WithValue(ctx, tokenConfigKey{}, tc)
+}
+
+// tokenConfigFrom returns the token configuration attached to ctx, or the
+// default one.
+func tokenConfigFrom(ctx context.Context) *tokenConfig {
+	if tc, ok := ctx.Value(tokenConfigKey{}).(*tokenConfig); ok {
+		return tc
+	}
+	return defaultTokenConfig
+}
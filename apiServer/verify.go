@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+const (
+	reachableYes     = "yes"
+	reachableNo      = "no"
+	reachableUnknown = "unknown"
+)
+
+// Verifier runs the same checks as emailVerifier.Verifier.Verify. The
+// address, misc and MX checks come from the library, while the SMTP check
+// goes through smtpProbe so the server's replies are available.
+type Verifier struct {
+	checks *emailVerifier.Verifier
+	smtp   *smtpProbe
+
+	// run replaces the checks of verify when set, so tests can exercise
+	// the handlers, the cache and the bulk ordering on canned results
+	// without network access. Verify still caches what it returns.
+	run verifyFunc
+}
+
+// verifyFunc runs the checks of a single verification, without caching.
+type verifyFunc func(ctx context.Context, email string, opts verifyOptions) (*Verification, error)
+
+// Verification is the outcome of verifying a single address.
+type Verification struct {
+	Result     *emailVerifier.Result
+	SMTPReply  *smtpReply // last reply of the SMTP dialog, nil if it didn't run
+	VerifiedAt time.Time
+	Cached     bool     // served from the result cache
+	Notes      []string // checks that were skipped or degraded, and why
+
+	// SyntaxError is why an address the library parsed was still found
+	// invalid, see SYNTAX_MODE and CHECK_TLD
+	SyntaxError string
+
+	// Timings are the milliseconds spent in the network phases that ran:
+	// "mx" for the MX lookup, "dns" for resolving the MX hosts and "smtp"
+	// for the SMTP check
+	Timings map[string]int64
+	// MXTTL is the lowest TTL left on the MX records when they were looked
+	// up, -1 when it isn't known
+	MXTTL time.Duration
+}
+
+// timed records the time spent in phase since start.
+func (v *Verification) timed(phase string, start time.Time) {
+	if v.Timings == nil {
+		v.Timings = map[string]int64{}
+	}
+	v.Timings[phase] = time.Since(start).Milliseconds()
+}
+
+// Notes reported in verification responses
+const (
+	noteSkippedCatchAllDomain = "smtp_skipped_catch_all_domain"
+	noteSkippedTimeoutDomain  = "smtp_skipped_timeout_domain"
+	noteSkippedNoProxy        = "smtp_skipped_no_proxy"
+	noteSkippedPassive        = "smtp_skipped_passive"
+	noteBudgetExceeded        = "budget_exceeded"
+	noteForcedMXHost          = "smtp_forced_mx_host"
+	noteSkippedFree           = "smtp_skipped_free"
+)
+
+// verifyOptions toggle the optional checks of a verification.
+type verifyOptions struct {
+	SMTP     bool // probe the mailbox over SMTP
+	Gravatar bool // look up a gravatar for the address
+	Suggest  bool // suggest a correction for misspelled domains
+	Force    bool // bypass the result cache and domain reputations
+
+	// PerAddress probes every address even at a domain known to be
+	// catch-all, instead of reusing the domain's classification.
+	PerAddress bool
+
+	// Passive never contacts the domain's mail servers. The verdict rests
+	// on the MX records, the address classifications and what is already
+	// known about the domain, so it is less certain than an SMTP check.
+	Passive bool
+
+	// MXHost is dialed instead of the domain's MX hosts. Such verifications
+	// are diagnostics, they are neither cached nor counted in the domain's
+	// reputation.
+	MXHost string
+
+	// Per-request overrides of FROM_EMAIL and HELO_NAME, see validateSender
+	FromEmail string
+	HeloName  string
+
+	// Bulk delays the SMTP connection by up to SMTP_JITTER_MAX, set for
+	// the emails of bulk requests and jobs.
+	Bulk bool
+}
+
+// defaultVerifyOptions are the checks run when a request doesn't choose.
+var defaultVerifyOptions = verifyOptions{SMTP: true}
+
+// cacheKey identifies a verification of email with these options, since
+// each combination caches a different result. The sender overrides come
+// last, see GetDebugCache.
+func (o verifyOptions) cacheKey(email string) string {
+	o.Force, o.Bulk = false, false
+	if o == defaultVerifyOptions {
+		return email
+	}
+	return fmt.Sprintf("%s|smtp=%t,gravatar=%t,suggest=%t,per_address=%t,passive=%t,from=%s,helo=%s",
+		email, o.SMTP, o.Gravatar, o.Suggest, o.PerAddress, o.Passive, o.FromEmail, o.HeloName)
+}
+
+// verifyOptionsFromRequest returns the default options, forced when the
+// request has ?force=true, probing each address with ?per_address=true,
+// passive with ?passive=true and suggesting corrections with
+// ?verify_suggestion=true, restricted to the checks the request's token is
+// allowed.
+func verifyOptionsFromRequest(r *http.Request) verifyOptions {
+	opts := defaultVerifyOptions
+	opts.Force = r.URL.Query().Get("force") == "true"
+	opts.PerAddress = r.URL.Query().Get("per_address") == "true"
+	opts.Passive = r.URL.Query().Get("passive") == "true"
+	opts.Suggest = r.URL.Query().Get("verify_suggestion") == "true"
+	return tokenConfigFrom(r.Context()).restrict(opts)
+}
+
+// IP_NETWORK is the network MX hosts are dialed on, set from IPV6_PREFERENCE.
+var IP_NETWORK = "tcp"
+
+// SMTP_COMMAND_DELAY is the pause between SMTP commands, off by default.
+var SMTP_COMMAND_DELAY time.Duration
+
+// SMTP_JITTER_MAX bounds the random wait before each SMTP connection of a
+// bulk verification. Bulk lists often hold many addresses at the same
+// domain, and spreading their connections out keeps them from tripping the
+// burst limits of its MX servers. Zero disables it.
+var SMTP_JITTER_MAX = 200 * time.Millisecond
+
+// EMAIL_TOTAL_BUDGET caps the time spent verifying a single address across
+// all of its DNS, SMTP, gravatar and RDAP work. Once it runs out the checks
+// that remain are skipped and the result obtained so far is returned. Zero
+// disables it, an SMTP dialog is still bounded by its own timeouts.
+var EMAIL_TOTAL_BUDGET time.Duration
+
+// SMTP_STARTTLS upgrades SMTP connections with STARTTLS when the server
+// offers it. Off by default, since checking a mailbox sends nothing
+// sensitive.
+var SMTP_STARTTLS bool
+
+// SMTP_TLS_INSECURE skips certificate verification on STARTTLS, for MX
+// servers with self-signed or expired certificates that would otherwise
+// fail the check over TLS rather than over the mailbox. It leaves the
+// connection open to interception, which at worst falsifies that check's
+// result, so it stays off unless explicitly set.
+var SMTP_TLS_INSECURE bool
+
+// MX_TRY_LIMIT bounds how many MX hosts an SMTP check dials. Domains with
+// many MX records would otherwise open a connection to each of them.
+var MX_TRY_LIMIT = 3
+
+// SKIP_SMTP_FOR_FREE skips the SMTP check at free providers such as Gmail,
+// Yahoo or Outlook. Their servers often accept any recipient or rate limit
+// probes, so their answers say little, and the result rests on the syntax,
+// the MX records and the provider instead.
+var SKIP_SMTP_FOR_FREE bool
+
+// SMTP_EMPTY_SENDER probes with the null sender, MAIL FROM:<>, instead of
+// FROM_EMAIL. It is the conventional sender of bounces and verification
+// probes, so MAIL FROM can't be rejected over the sender's domain and no
+// rejections or spam traps are tied to FROM_EMAIL's reputation. Some
+// servers distrust it however, and reject or tarpit null-sender probes
+// more often than ones from a real sender, so results can get less
+// conclusive. Per-request from_email overrides still apply. Off by default.
+var SMTP_EMPTY_SENDER bool
+
+// REQUIRE_PROXY disables SMTP checks while no proxy is configured. Cloud
+// hosts usually block outbound port 25, so direct probes fail and produce
+// misleading results.
+var REQUIRE_PROXY bool
+
+// sharedVerifier returns the Verifier used by every request, created from
+// the environment on first use, once main has applied its settings. Its
+// configuration doesn't change afterwards, so FROM_EMAIL and HELO_NAME
+// aren't reloaded by SIGHUP. It is safe for concurrent use: the library
+// checks only read their configuration and verify copies the probe before
+// applying per-request overrides. Tests can replace it with one returning a
+// Verifier whose run is set.
+var sharedVerifier = sync.OnceValue(newEnvVerifier)
+
+// newEnvVerifier creates a Verifier configured from the environment.
+func newEnvVerifier() *Verifier {
+	fromEmail := os.Getenv("FROM_EMAIL")
+	if SMTP_EMPTY_SENDER {
+		fromEmail = ""
+	}
+	// HELO_NAMES lists EHLO names to fall back on in order, for servers
+	// rejecting some of them, as when they don't match the reverse DNS of
+	// the connection
+	heloNames := envList("HELO_NAMES")
+	if len(heloNames) == 0 {
+		heloNames = []string{os.Getenv("HELO_NAME")}
+	}
+	return &Verifier{
+		checks: emailVerifier.NewVerifier(),
+		smtp: &smtpProbe{
+			fromEmail:        fromEmail,
+			heloNames:        heloNames,
+			proxies:          proxies,
+			network:          IP_NETWORK,
+			connectTimeout:   10 * time.Second,
+			operationTimeout: 10 * time.Second,
+			commandDelay:     SMTP_COMMAND_DELAY,
+			mxTryLimit:       MX_TRY_LIMIT,
+			startTLS:         SMTP_STARTTLS,
+			tlsInsecure:      SMTP_TLS_INSECURE,
+			publicOnly:       REJECT_PRIVATE_MX,
+		},
+	}
+}
+
+// Verify returns the cached verification for email when there is one, and
+// otherwise verifies it and caches the outcome if it succeeded. Either way
+// the outcome counts towards the abuse tracking of the request's token, is
+// published to BROKER_URL and recorded in DATABASE_URL. A trailing dot in
+// the domain is dropped first, the result reporting the address without it.
+func (v *Verifier) Verify(ctx context.Context, email string, opts verifyOptions) (*Verification, error) {
+	key := opts.cacheKey(addressKey(email))
+	email = trimTrailingDot(email)
+	// Forced and MX-pinned verifications aren't lookups of the cache
+	if !opts.Force && opts.MXHost == "" {
+		if cached, ok := cache.get(key); ok {
+			debugf(ctx, "%s: cache hit, verified at %s", email, cached.VerifiedAt.Format(time.RFC3339))
+			hit := *cached
+			hit.Cached = true
+			if hit.Result.Email != email {
+				// Cached under another case or Unicode form of the address
+				result := *hit.Result
+				result.Email = email
+				hit.Result = &result
+			}
+			abuse.record(tokenConfigFrom(ctx).id, &hit, nil)
+			publishVerification(ctx, email, &hit, nil)
+			recordVerification(ctx, email, &hit, nil)
+			return &hit, nil
+		}
+	}
+
+	run := v.verify
+	if v.run != nil {
+		run = v.run
+	}
+	verification, err := run(ctx, email, opts)
+	if err != nil && ctx.Err() != nil {
+		// Cut short by the end of the request, there is no outcome to record
+		return verification, err
+	}
+	if err == nil && cacheable(verification) && opts.MXHost == "" {
+		cache.set(key, verification)
+	}
+	abuse.record(tokenConfigFrom(ctx).id, verification, err)
+	publishVerification(ctx, email, verification, err)
+	recordVerification(ctx, email, verification, err)
+	return verification, err
+}
+
+// verify performs address, misc, mx and smtp checks
+func (v *Verifier) verify(ctx context.Context, email string, opts verifyOptions) (*Verification, error) {
+	ret := emailVerifier.Result{
+		Email:     email,
+		Reachable: reachableUnknown,
+	}
+	verification := &Verification{Result: &ret, VerifiedAt: time.Now(), MXTTL: -1}
+	opts, verification.Notes = degrade(opts)
+
+	// The checks stop once the request ends or the budget runs out, except
+	// for an SMTP dialog already holding its slots, see smtpProbe.check
+	caller := ctx
+	var budgetEnd time.Time
+	if EMAIL_TOTAL_BUDGET > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, EMAIL_TOTAL_BUDGET)
+		defer cancel()
+		budgetEnd = time.Now().Add(EMAIL_TOTAL_BUDGET)
+	}
+	overBudget := func(step string) (*Verification, error) {
+		if err := caller.Err(); err != nil {
+			debugf(ctx, "%s: request ended, %s skipped", email, step)
+			return verification, err
+		}
+		debugf(ctx, "%s: budget of %s exceeded, %s skipped", email, EMAIL_TOTAL_BUDGET, step)
+		verification.Notes = append(verification.Notes, noteBudgetExceeded)
+		return verification, nil
+	}
+
+	syntax := v.checks.ParseAddress(email)
+	ret.Syntax = syntax
+	if strings.HasSuffix(email, "..") {
+		debugf(ctx, "%s: domain ends in several dots", email)
+		ret.Syntax.Valid = false
+		verification.SyntaxError = syntaxErrorTrailingDots
+		return verification, nil
+	}
+	if !syntax.Valid {
+		debugf(ctx, "%s: invalid syntax", email)
+		return verification, nil
+	}
+	if strings.HasPrefix(syntax.Username, `"`) {
+		if reason := quotedLocalPartError(syntax.Username); reason != "" {
+			debugf(ctx, "%s: invalid quoted local part, %s", email, reason)
+			ret.Syntax.Valid = false
+			verification.SyntaxError = reason
+			return verification, nil
+		}
+	}
+	if SYNTAX_MODE == "strict" {
+		if reason := strictSyntaxError(email); reason != "" {
+			debugf(ctx, "%s: invalid strict syntax, %s", email, reason)
+			ret.Syntax.Valid = false
+			verification.SyntaxError = reason
+			return verification, nil
+		}
+	}
+	internal := internalDomain(syntax.Domain)
+	if CHECK_TLD && !knownTLD(syntax.Domain) && !internal {
+		debugf(ctx, "%s: unknown top-level domain", email)
+		ret.Syntax.Valid = false
+		verification.SyntaxError = syntaxErrorInvalidTLD
+		return verification, nil
+	}
+
+	ret.Free = v.checks.IsFreeDomain(syntax.Domain)
+	ret.RoleAccount = v.checks.IsRoleAccount(syntax.Username)
+	ret.Disposable = v.isDisposable(syntax.Domain)
+	debugf(ctx, "%s: domain %s, free=%t role=%t disposable=%t", email, syntax.Domain, ret.Free, ret.RoleAccount, ret.Disposable)
+
+	// If the domain name is disposable, mx and smtp are not checked.
+	if ret.Disposable {
+		return verification, nil
+	}
+
+	start := time.Now()
+	mx, mxTTL, err := checkMX(ctx, syntax.Domain)
+	verification.timed("mx", start)
+	if ctx.Err() != nil {
+		return overBudget("MX check")
+	}
+	if err != nil {
+		debugf(ctx, "%s: MX lookup failed after %s: %v", email, time.Since(start), err)
+		return verification, err
+	}
+	ret.HasMxRecords = mx.HasMXRecord
+	verification.MXTTL = mxTTL
+	debugf(ctx, "%s: %d MX records in %s", email, len(mx.Records), time.Since(start))
+
+	if opts.SMTP && opts.Passive {
+		debugf(ctx, "%s: SMTP check skipped, passive verification", email)
+		verification.Notes = append(verification.Notes, noteSkippedPassive)
+		if domains.skipReason(syntax.Domain, false) == noteSkippedCatchAllDomain {
+			ret.SMTP, _ = skippedSMTP(noteSkippedCatchAllDomain)
+		}
+	} else if opts.SMTP && SKIP_SMTP_FOR_FREE && ret.Free && opts.MXHost == "" {
+		debugf(ctx, "%s: SMTP check skipped, free provider", email)
+		verification.Notes = append(verification.Notes, noteSkippedFree)
+	} else if opts.SMTP && REQUIRE_PROXY && len(v.smtp.proxies.proxies) == 0 {
+		debugf(ctx, "%s: SMTP check skipped, no proxy configured", email)
+		verification.Notes = append(verification.Notes, noteSkippedNoProxy)
+	} else if opts.SMTP {
+		probe := *v.smtp
+		if opts.FromEmail != "" {
+			probe.fromEmail = opts.FromEmail
+		}
+		if opts.HeloName != "" {
+			probe.heloNames = []string{opts.HeloName}
+		}
+		if opts.Bulk {
+			probe.jitterMax = SMTP_JITTER_MAX
+		}
+		probe.deadline = budgetEnd
+		if internal {
+			probe.publicOnly = false
+		}
+		if opts.MXHost != "" {
+			debugf(ctx, "%s: SMTP check forced to %s", email, opts.MXHost)
+			probe.mxHost = opts.MXHost
+			verification.Notes = append(verification.Notes, noteForcedMXHost)
+		} else if REJECT_PRIVATE_MX && !internal {
+			start = time.Now()
+			err := checkMXRoutable(ctx, mx.Records)
+			verification.timed("dns", start)
+			if err != nil {
+				debugf(ctx, "%s: SMTP check skipped, %v", email, err)
+				return verification, err
+			}
+		}
+
+		var smtp *emailVerifier.SMTP
+		var reply *smtpReply
+		start = time.Now()
+		if reason := domains.skipReason(syntax.Domain, opts.PerAddress); reason != "" && !opts.Force && opts.MXHost == "" {
+			debugf(ctx, "%s: SMTP check skipped, %s", email, reason)
+			verification.Notes = append(verification.Notes, reason)
+			smtp, err = skippedSMTP(reason)
+		} else {
+			smtp, reply, err = probeThroughBreaker(ctx, &probe, syntax.Domain, syntax.Username)
+			verification.timed("smtp", start)
+			if errors.Is(err, errSMTPUnavailable) {
+				debugf(ctx, "%s: SMTP check skipped, circuit breaker open", email)
+				verification.Notes = append(verification.Notes, noteSMTPUnavailable)
+				return verification, nil
+			}
+			if err != nil && ctx.Err() != nil {
+				verification.SMTPReply = reply
+				return overBudget("SMTP check")
+			}
+			if opts.MXHost == "" {
+				domains.record(syntax.Domain, smtp, err)
+			}
+		}
+		verification.SMTPReply = reply
+		if err != nil {
+			debugf(ctx, "%s: SMTP check failed after %s: %v", email, time.Since(start), err)
+			if !degradable(checkSMTP) {
+				return verification, err
+			}
+			verification.Notes = append(verification.Notes, noteDegradedPrefix+checkSMTP)
+		} else {
+			ret.SMTP = smtp
+			ret.Reachable = calculateReachable(smtp)
+			debugf(ctx, "%s: SMTP check in %s, reachable=%s", email, time.Since(start), ret.Reachable)
+		}
+	}
+
+	if opts.Gravatar {
+		if ctx.Err() != nil {
+			return overBudget("gravatar check")
+		}
+		gravatar, err := gravatars.check(ctx, email)
+		if err != nil && ctx.Err() != nil {
+			return overBudget("gravatar check")
+		}
+		if err != nil && !degradable(checkGravatar) {
+			return verification, err
+		}
+		if err != nil {
+			debugf(ctx, "%s: gravatar check failed: %v", email, err)
+			verification.Notes = append(verification.Notes, noteDegradedPrefix+checkGravatar)
+		}
+		ret.Gravatar = gravatar
+	}
+
+	if opts.Suggest {
+		ret.Suggestion = v.checks.SuggestDomain(syntax.Domain)
+	}
+
+	return verification, nil
+}
+
+// budgetContext bounds ctx by what is left of the EMAIL_TOTAL_BUDGET of v,
+// for the lookups made once it is verified. Cached verifications get a
+// budget of their own, serving them took nothing from it.
+func budgetContext(ctx context.Context, v *Verification) (context.Context, context.CancelFunc) {
+	switch {
+	case EMAIL_TOTAL_BUDGET <= 0:
+		return context.WithCancel(ctx)
+	case v.Cached:
+		return context.WithTimeout(ctx, EMAIL_TOTAL_BUDGET)
+	default:
+		return context.WithDeadline(ctx, v.VerifiedAt.Add(EMAIL_TOTAL_BUDGET))
+	}
+}
+
+// cacheable reports whether v may be cached. Outcomes reusing a catch-all
+// domain's classification aren't cached per address, the domain reputation
+// already holds them, and outcomes degraded by the circuit breaker, an
+// exhausted budget or DEGRADE_ORDER would outlive the cause.
+func cacheable(v *Verification) bool {
+	for _, note := range v.Notes {
+		if strings.HasPrefix(note, noteDegradedPrefix) {
+			return false
+		}
+		switch note {
+		case noteSkippedCatchAllDomain, noteSMTPUnavailable, noteBudgetExceeded:
+			return false
+		}
+	}
+	return true
+}
+
+// checkMX is the library's MX check, with the lookup going through
+// resolver.
+func checkMX(ctx context.Context, domain string) (*emailVerifier.Mx, time.Duration, error) {
+	records, ttl, err := resolver.lookupMX(ctx, domainToASCII(domain))
+	if err != nil && len(records) == 0 {
+		return nil, -1, err
+	}
+	return &emailVerifier.Mx{HasMXRecord: len(records) > 0, Records: records}, ttl, nil
+}
+
+func calculateReachable(s *emailVerifier.SMTP) string {
+	if s.Deliverable {
+		return reachableYes
+	}
+	if s.CatchAll {
+		return reachableUnknown
+	}
+	return reachableNo
+}
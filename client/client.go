@@ -0,0 +1,202 @@
+// Package client is a Go client for the email verifier API's bulk endpoint.
+//
+// It sets the Authorization header, splits lists larger than the server's
+// bulk limit into several requests and retries transient failures:
+//
+//	c := client.New("https://verifier.internal:8080", os.Getenv("VERIFIER_TOKEN"))
+//	results, err := c.VerifyBulk([]string{"a@example.com", "b@example.org"})
+//	if err != nil {
+//		return err
+//	}
+//	for _, res := range results {
+//		fmt.Println(res.Email, res.Result.Reachable)
+//	}
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+// DefaultMaxEmails matches the server's default bulk limit.
+const DefaultMaxEmails = 15
+
+// Result is the verification result for a single address.
+type Result struct {
+	SchemaVersion int `json:"schema_version"`
+	emailVerifier.Result
+	LocalPart   string  `json:"local_part,omitempty"`
+	Domain      string  `json:"domain,omitempty"`
+	DomainASCII string  `json:"domain_ascii,omitempty"`
+	VerifiedAt  string  `json:"verified_at"`
+	AgeSeconds  *int64  `json:"age_seconds,omitempty"`
+	Deliverable bool    `json:"deliverable"`
+	Confidence  float64 `json:"confidence"`
+
+	NormalizedEmail  string   `json:"normalized_email,omitempty"`
+	Notes            []string `json:"notes,omitempty"`
+	SyntaxError      string   `json:"syntax_error,omitempty"`
+	Passive          bool     `json:"passive,omitempty"`
+	SMTPHost         string   `json:"smtp_host,omitempty"`
+	ForcedMXHost     bool     `json:"forced_mx_host,omitempty"`
+	Input            string   `json:"input,omitempty"`
+	SuggestionResult *Result  `json:"suggestion_result,omitempty"` // with verify_suggestion
+
+	Timings  map[string]int64 `json:"timings,omitempty"` // with timings
+	EmailNFC string           `json:"email_nfc,omitempty"`
+
+	CustomClassification string `json:"custom_classification,omitempty"` // with CLASSIFICATION_RULES
+	MXTTL                *int64 `json:"mx_ttl,omitempty"`                // seconds
+
+	Raw              *emailVerifier.Result `json:"raw,omitempty"`               // with raw
+	HomographSuspect *bool                 `json:"homograph_suspect,omitempty"` // with HOMOGRAPH_CHECK
+	DomainAgeDays    *int                  `json:"domain_age_days,omitempty"`   // with domain_age
+	YoungDomain      *bool                 `json:"young_domain,omitempty"`      // with domain_age
+	BaseEmail        string                `json:"base_email,omitempty"`
+
+	Reasons []string `json:"reasons,omitempty"` // why deliverable is false
+}
+
+// BulkVerificationResult is one entry of a bulk verification response.
+type BulkVerificationResult struct {
+	Email       string  `json:"email"`
+	Result      *Result `json:"result,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	SMTPCode    int     `json:"smtp_code,omitempty"`
+	SMTPMessage string  `json:"smtp_message,omitempty"`
+}
+
+// Client calls the verifier API. Create one by calling New.
+type Client struct {
+	BaseURL    string        // server URL, e.g. "http://localhost:8080"
+	Token      string        // sent as the Authorization header
+	MaxEmails  int           // emails per bulk request, at most the server's MAX_EMAILS
+	Retries    int           // extra attempts for a chunk after a transient failure
+	Backoff    time.Duration // wait before the first retry, doubled on each attempt
+	HTTPClient *http.Client
+}
+
+// New creates a client for the server at baseURL using the given token.
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		MaxEmails:  DefaultMaxEmails,
+		Retries:    2,
+		Backoff:    500 * time.Millisecond,
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// VerifyBulk verifies emails through the bulk endpoint, sending them in
+// chunks of MaxEmails. Results for all chunks are returned together; on
+// error, the results obtained so far are returned with it.
+func (c *Client) VerifyBulk(emails []string) ([]BulkVerificationResult, error) {
+	chunkSize := c.MaxEmails
+	if chunkSize <= 0 {
+		chunkSize = DefaultMaxEmails
+	}
+
+	results := make([]BulkVerificationResult, 0, len(emails))
+	for start := 0; start < len(emails); start += chunkSize {
+		end := min(start+chunkSize, len(emails))
+		chunk, err := c.verifyChunk(emails[start:end])
+		results = append(results, chunk...)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// verifyChunk sends one bulk request, retrying network errors, 429s and 5xx
+// responses.
+func (c *Client) verifyChunk(emails []string) ([]BulkVerificationResult, error) {
+	body, err := json.Marshal(map[string][]string{"emails": emails})
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		results, retry, err := c.post(body)
+		if err == nil || !retry || attempt >= c.Retries {
+			return results, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends a single bulk request. retry reports whether a failure is worth
+// retrying.
+func (c *Client) post(body []byte) (results []BulkVerificationResult, retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, c.BaseURL+"/v1/bulk", bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Authorization", c.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, retry, fmt.Errorf("bulk verification failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, false, fmt.Errorf("invalid bulk verification response: %w", err)
+	}
+
+	// Servers with RESPONSE_ENVELOPE wrap the results in "data"
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+		Meta json.RawMessage `json:"meta"`
+	}
+	if json.Unmarshal(raw, &envelope) == nil && envelope.Meta != nil {
+		raw = envelope.Data
+	}
+
+	// The server answers with an object instead of an array when it could
+	// only verify part of the emails in time
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '{' {
+		var partial struct {
+			Reason  string                   `json:"reason"`
+			Results []BulkVerificationResult `json:"results"`
+			Job     *struct {
+				ID string `json:"id"`
+			} `json:"job"`
+		}
+		if err := json.Unmarshal(trimmed, &partial); err != nil {
+			return nil, false, fmt.Errorf("invalid bulk verification response: %w", err)
+		}
+		if partial.Job != nil {
+			// Retrying would verify the remaining emails a second time
+			return partial.Results, false, fmt.Errorf("bulk verification incomplete: %s, the remaining emails are verified by job %s", partial.Reason, partial.Job.ID)
+		}
+		return partial.Results, true, fmt.Errorf("bulk verification incomplete: %s", partial.Reason)
+	}
+
+	if err := json.Unmarshal(raw, &results); err != nil {
+		return nil, false, fmt.Errorf("invalid bulk verification response: %w", err)
+	}
+	return results, false, nil
+}
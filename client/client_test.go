@@ -0,0 +1,181 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bulkServer answers each bulk request with respond, after checking its
+// method, path and Authorization header.
+func bulkServer(t *testing.T, respond func(w http.ResponseWriter, emails []string)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/bulk" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "secret" {
+			t.Errorf("Authorization header = %q, want %q", got, "secret")
+		}
+		var req struct {
+			Emails []string `json:"emails"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		respond(w, req.Emails)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// echoResults answers with a result per email.
+func echoResults(w http.ResponseWriter, emails []string) {
+	results := make([]BulkVerificationResult, len(emails))
+	for i, email := range emails {
+		results[i] = BulkVerificationResult{Email: email, Result: &Result{}}
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+func newTestClient(srv *httptest.Server) *Client {
+	c := New(srv.URL+"/", "secret")
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func TestVerifyBulkChunks(t *testing.T) {
+	var chunks [][]string
+	srv := bulkServer(t, func(w http.ResponseWriter, emails []string) {
+		chunks = append(chunks, emails)
+		echoResults(w, emails)
+	})
+	c := newTestClient(srv)
+	c.MaxEmails = 2
+
+	emails := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"}
+	results, err := c.VerifyBulk(emails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 || len(chunks[0]) != 2 || len(chunks[1]) != 2 || len(chunks[2]) != 1 {
+		t.Errorf("chunks = %v, want sizes 2, 2 and 1", chunks)
+	}
+	if len(results) != len(emails) {
+		t.Fatalf("got %d results, want %d", len(results), len(emails))
+	}
+	for i, res := range results {
+		if res.Email != emails[i] {
+			t.Errorf("result %d is for %s, want %s", i, res.Email, emails[i])
+		}
+	}
+}
+
+func TestVerifyBulkRetries(t *testing.T) {
+	tests := []struct {
+		status   int
+		attempts int32
+		ok       bool
+	}{
+		{http.StatusTooManyRequests, 2, true},
+		{http.StatusInternalServerError, 2, true},
+		{http.StatusServiceUnavailable, 2, true},
+		{http.StatusBadRequest, 1, false},
+		{http.StatusUnauthorized, 1, false},
+	}
+	for _, tt := range tests {
+		var attempts atomic.Int32
+		srv := bulkServer(t, func(w http.ResponseWriter, emails []string) {
+			if attempts.Add(1) == 1 {
+				http.Error(w, "failed", tt.status)
+				return
+			}
+			echoResults(w, emails)
+		})
+
+		results, err := newTestClient(srv).VerifyBulk([]string{"a@example.com"})
+		if got := attempts.Load(); got != tt.attempts {
+			t.Errorf("status %d: %d attempts, want %d", tt.status, got, tt.attempts)
+		}
+		if tt.ok && (err != nil || len(results) != 1) {
+			t.Errorf("status %d: got %d results, %v after retrying", tt.status, len(results), err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("status %d: no error", tt.status)
+		}
+	}
+}
+
+func TestVerifyBulkGivesUpAfterRetries(t *testing.T) {
+	var attempts atomic.Int32
+	srv := bulkServer(t, func(w http.ResponseWriter, emails []string) {
+		attempts.Add(1)
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	})
+	c := newTestClient(srv)
+	c.Retries = 3
+
+	if _, err := c.VerifyBulk([]string{"a@example.com"}); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got error %v, want the 503", err)
+	}
+	if got := attempts.Load(); got != 4 {
+		t.Errorf("%d attempts, want 4", got)
+	}
+}
+
+func TestVerifyBulkEnvelope(t *testing.T) {
+	srv := bulkServer(t, func(w http.ResponseWriter, emails []string) {
+		w.Write([]byte(`{"data": [{"email": "a@example.com", "result": {"deliverable": true}}], "meta": {"request_id": "1"}}`))
+	})
+
+	results, err := newTestClient(srv).VerifyBulk([]string{"a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Email != "a@example.com" || !results[0].Result.Deliverable {
+		t.Errorf("results = %+v, want the unwrapped result", results)
+	}
+}
+
+func TestVerifyBulkPartialWithJob(t *testing.T) {
+	var attempts atomic.Int32
+	srv := bulkServer(t, func(w http.ResponseWriter, emails []string) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"partial": true, "reason": "deadline_exceeded", "results": [{"email": "a@example.com", "result": {}}], "job": {"id": "j1"}}`))
+	})
+
+	results, err := newTestClient(srv).VerifyBulk([]string{"a@example.com", "b@example.com"})
+	if err == nil || !strings.Contains(err.Error(), "job j1") {
+		t.Errorf("got error %v, want one naming job j1", err)
+	}
+	if len(results) != 1 || results[0].Email != "a@example.com" {
+		t.Errorf("results = %+v, want the completed one", results)
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("%d attempts, want no retry", got)
+	}
+}
+
+func TestVerifyBulkPartialRetried(t *testing.T) {
+	var attempts atomic.Int32
+	srv := bulkServer(t, func(w http.ResponseWriter, emails []string) {
+		if attempts.Add(1) == 1 {
+			w.Write([]byte(`{"partial": true, "reason": "deadline_exceeded", "results": []}`))
+			return
+		}
+		echoResults(w, emails)
+	})
+
+	results, err := newTestClient(srv).VerifyBulk([]string{"a@example.com"})
+	if err != nil || len(results) != 1 {
+		t.Errorf("got %d results, %v, want the retried chunk", len(results), err)
+	}
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("%d attempts, want 2", got)
+	}
+}
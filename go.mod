@@ -3,10 +3,28 @@ module email-verifier
 go 1.23.4
 
 require (
-	github.com/AfterShip/email-verifier v1.4.1 // indirect
+	github.com/AfterShip/email-verifier v1.4.1
+	github.com/joho/godotenv v1.5.1
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/lib/pq v1.10.9
+	github.com/miekg/dns v1.1.62
+	github.com/nats-io/nats.go v1.37.0
+	github.com/segmentio/kafka-go v0.4.47
+	github.com/sony/gobreaker v1.0.0
+	golang.org/x/net v0.33.0
+	golang.org/x/sync v0.10.0
+	golang.org/x/text v0.21.0
+	golang.org/x/time v0.8.0
+)
+
+require (
 	github.com/hbollon/go-edlib v1.6.0 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/julienschmidt/httprouter v1.3.0 // indirect
-	golang.org/x/net v0.33.0 // indirect
-	golang.org/x/text v0.21.0 // indirect
+	github.com/klauspost/compress v1.17.2 // indirect
+	github.com/nats-io/nkeys v0.4.7 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 )